@@ -2,10 +2,13 @@ package app
 
 import (
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/aravinth2094/goginx/config"
@@ -20,8 +23,18 @@ import (
 	"go.uber.org/zap"
 )
 
-func initialize() string {
+type options struct {
+	configFileLocation string
+	format             string
+	watchInterval      time.Duration
+}
+
+func initialize() options {
 	configFileLocation := flag.String("c", "goginx.json", "Goginx configuration file location")
+	format := flag.String("F", "", "Configuration file format: json, yaml or toml (detected from the extension or Content-Type by default)")
+	watchInterval := flag.Int("w", 5, "Configuration reload poll interval in seconds (0 disables watching)")
+	publicKey := flag.String("k", "", "Ed25519 public key file used to verify the signature of remote configuration files")
+	cacheDir := flag.String("C", defaultCacheDir(), "Directory caching the last good copy of remote configuration files")
 	validate := flag.Bool("V", false, "Validate configuration file")
 	help := flag.Bool("h", false, "Print this help")
 	flag.Parse()
@@ -29,74 +42,127 @@ func initialize() string {
 		flag.Usage()
 		os.Exit(0)
 	}
+	remoteOptions := config.RemoteOptions{
+		Timeout:  10 * time.Second,
+		CacheDir: *cacheDir,
+	}
+	if *publicKey != "" {
+		key, err := config.ReadPublicKey(*publicKey)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		remoteOptions.PublicKey = key
+	}
+	config.SetRemoteOptions(remoteOptions)
+	gin.SetMode(gin.ReleaseMode)
+	gin.DisableConsoleColor()
 	if *validate {
-		conf, err := getConfigurationFromFile(*configFileLocation)
+		conf, err := getConfigurationFromFile(*configFileLocation, *format)
 		if err != nil {
 			log.Fatalln(err)
 		}
 		if err := conf.Validate(); err != nil {
 			log.Fatalln(err)
 		}
+		for i, route := range conf.Routes {
+			fmt.Printf("%s\t%s\t%s\n", route.Path, route.ForwardUrl, conf.Locations.Locate(fmt.Sprintf("routes[%d]", i)))
+		}
 		os.Exit(0)
 	}
-	gin.SetMode(gin.ReleaseMode)
-	gin.DisableConsoleColor()
-	return *configFileLocation
+	return options{
+		configFileLocation: *configFileLocation,
+		format:             *format,
+		watchInterval:      time.Duration(*watchInterval) * time.Second,
+	}
 }
 
-func initLogFile(conf *handler.Configuration) error {
+func defaultCacheDir() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cacheDir, "goginx")
+}
+
+func initLogFile(conf *handler.Configuration) (*os.File, error) {
 	logfile, err := os.OpenFile(conf.Log, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	gin.DefaultWriter = io.MultiWriter(logfile)
-	return nil
+	return logfile, nil
 }
 
-func getConfigurationFromFile(configurationFile string) (*handler.Configuration, error) {
-	conf, err := config.ParseConfig(configurationFile)
+func getConfigurationFromFile(configurationFile string, format string) (*handler.Configuration, error) {
+	conf, err := config.ParseConfigWithFormat(configurationFile, format)
 	if err != nil {
 		return nil, err
 	}
 	return conf, nil
 }
 
-func StartWithConfig(conf *handler.Configuration) error {
-	if err := conf.Validate(); err != nil {
-		return err
-	}
-	err := initLogFile(conf)
-	if err != nil {
-		return err
-	}
-	r := gin.New()
-	logger, _ := zap.NewProduction()
-	r.Use(conf.GetLoggingHandler())
-	r.Use(ginzap.Ginzap(logger, time.RFC3339, true))
-	r.Use(ginzap.RecoveryWithZap(logger, true))
+// metrics holds the middleware and the /metrics handler of the gin-metrics
+// monitor. The monitor keeps global state that is reset whenever it is set up,
+// so it is set up once and its handlers are attached to every engine built
+// on reload.
+type metrics struct {
+	middleware gin.HandlersChain
+	endpoint   gin.HandlerFunc
+}
+
+func newMetrics() *metrics {
 	m := ginmetrics.GetMonitor()
 	m.SetMetricPath("/metrics")
 	m.SetSlowTime(10)
 	m.SetDuration([]float64{0.1, 0.3, 1.2, 5, 10})
+	r := gin.New()
 	m.Use(r)
-	if conf.Compression {
-		r.Use(gzip.Gzip(gzip.DefaultCompression))
+	handler.RegisterMetrics(m)
+	return &metrics{middleware: r.Handlers, endpoint: r.Routes()[0].HandlerFunc}
+}
+
+func newEngine(conf *handler.Configuration, discoveryService *handler.DiscoveryService, metrics *metrics) *gin.Engine {
+	r := gin.New()
+	// Client IPs are resolved by goginx from trustedProxies and clientIpHeader.
+	r.ForwardedByClientIP = false
+	logger, _ := zap.NewProduction()
+	r.Use(conf.GetClientIPHandler())
+	r.Use(conf.GetLoggingHandler())
+	r.Use(ginzap.Ginzap(logger, time.RFC3339, true))
+	r.Use(ginzap.RecoveryWithZap(logger, true))
+	r.Use(metrics.middleware...)
+	var access gin.HandlersChain
+	if len(conf.WhiteList) > 0 || len(conf.Access) > 0 {
+		access = gin.HandlersChain{conf.GetAccessHandler()}
 	}
-	if len(conf.WhiteList) > 0 {
-		r.Use(conf.GetWhitelistHandler())
+	// The metrics are compressed by their own handler, so they are
+	// registered ahead of the gzip middleware with the access rules only.
+	r.GET("/metrics", append(access, metrics.endpoint)...)
+	if conf.Compression {
+		// The discovery watch stream has to be flushed event by event.
+		r.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithExcludedPaths([]string{"/discovery"})))
 	}
-	var discoveryHandler gin.HandlerFunc
-	var discoveryService *handler.DiscoveryService
+	r.Use(access...)
 	if conf.Discovery {
-		discoveryHandler, discoveryService = conf.GetDiscoveryHandler()
-		r.POST("/discovery", discoveryHandler)
+		var registration gin.IRoutes = r
+		if conf.DiscoveryAuth != nil {
+			registration = r.Group("", conf.GetDiscoveryAuthHandler())
+		}
+		registration.POST("/discovery", discoveryService.GetRegistrationHandler())
+		registration.DELETE("/discovery", discoveryService.GetDeregistrationHandler())
+		r.GET("/discovery", discoveryService.GetQueryHandler())
+		r.GET("/discovery/:service", discoveryService.GetQueryHandler())
 	}
 	r.HandleMethodNotAllowed = true
 	var store *persistence.InMemoryStore
 
 	for _, route := range conf.Routes {
-		if route.ForwardUrl[:7] == "file://" {
-			r.StaticFS(route.Path, http.Dir(route.ForwardUrl[7:]))
+		var routes gin.IRoutes = r
+		if len(route.Access) > 0 {
+			routes = r.Group("", route.GetAccessHandler())
+		}
+		if strings.HasPrefix(route.ForwardUrl, "file://") {
+			routes.StaticFS(route.Path, http.Dir(route.ForwardUrl[7:]))
 			continue
 		}
 		for _, method := range route.AllowedMethods {
@@ -113,20 +179,33 @@ func StartWithConfig(conf *handler.Configuration) error {
 					timeout.WithHandler(handlerFunction),
 				)
 			}
-			r.Handle(method, route.Path, handlerFunction)
+			routes.Handle(method, route.Path, handlerFunction)
 		}
 	}
+	return r
+}
 
-	if conf.Certificate != "" && conf.Key != "" {
-		return r.RunTLS(conf.Listen, conf.Certificate, conf.Key)
-	}
-	return r.Run(conf.Listen)
+// buildEngine builds the engine of a configuration, turning a panic of gin
+// on a route it cannot add into an error so that a reload keeps the running
+// engine.
+func buildEngine(conf *handler.Configuration, discoveryService *handler.DiscoveryService, metrics *metrics) (engine *gin.Engine, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("building the routes failed: %v", recovered)
+		}
+	}()
+	return newEngine(conf, discoveryService, metrics), nil
+}
+
+func StartWithConfig(conf *handler.Configuration) error {
+	return run(conf, options{})
 }
 
 func Start() error {
-	conf, err := getConfigurationFromFile(initialize())
+	opts := initialize()
+	conf, err := getConfigurationFromFile(opts.configFileLocation, opts.format)
 	if err != nil {
 		return err
 	}
-	return StartWithConfig(conf)
+	return run(conf, opts)
 }
@@ -0,0 +1,238 @@
+package app
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aravinth2094/goginx/config"
+	"github.com/aravinth2094/goginx/handler"
+	"github.com/gin-gonic/gin"
+)
+
+// server hands every request to the current gin engine. A configuration
+// reload builds a new engine and swaps it in atomically, so requests already
+// in flight finish on the engine they started on and no connection is dropped.
+// The configuration, the registry and the log file are guarded by mu, and no
+// reload is applied once the shutdown started.
+type server struct {
+	engine           atomic.Value
+	opts             options
+	metrics          *metrics
+	stop             chan struct{}
+	mu               sync.Mutex
+	closed           bool
+	conf             *handler.Configuration
+	discoveryService *handler.DiscoveryService
+	logFile          *os.File
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.engine.Load().(*gin.Engine).ServeHTTP(w, r)
+}
+
+// apply validates and installs a configuration. It must be called with mu
+// held.
+func (s *server) apply(conf *handler.Configuration) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	if conf.Discovery && s.discoveryService == nil {
+		_, s.discoveryService = conf.GetDiscoveryHandler()
+	}
+	engine, err := buildEngine(conf, s.discoveryService, s.metrics)
+	if err != nil {
+		conf.Close()
+		return err
+	}
+	if s.logFile == nil || s.conf.Log != conf.Log {
+		logFile, err := initLogFile(conf)
+		if err != nil {
+			return err
+		}
+		if s.logFile != nil {
+			s.logFile.Close()
+		}
+		s.logFile = logFile
+	}
+	if s.discoveryService != nil {
+		s.discoveryService.SetHealthCheck(conf.DiscoveryHealthCheck)
+	}
+	s.engine.Store(engine)
+	if s.conf != nil {
+		s.conf.Close()
+	}
+	s.conf = conf
+	return nil
+}
+
+func (s *server) reload() {
+	conf, err := getConfigurationFromFile(s.opts.configFileLocation, s.opts.format)
+	if err != nil {
+		log.Printf("reload of %s failed, keeping current configuration: %s", s.opts.configFileLocation, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if conf.Listen != s.conf.Listen || conf.Certificate != s.conf.Certificate || conf.Key != s.conf.Key || conf.ProxyProtocol != s.conf.ProxyProtocol {
+		log.Println("WARNING: listen, certificate, key and proxyProtocol changes require a restart and were not applied.")
+		conf.Listen, conf.Certificate, conf.Key, conf.ProxyProtocol = s.conf.Listen, s.conf.Certificate, s.conf.Key, s.conf.ProxyProtocol
+	}
+	if clientCa(conf) != clientCa(s.conf) {
+		log.Println("WARNING: discoveryAuth.clientCa changes require a restart and were not applied.")
+		if conf.DiscoveryAuth != nil {
+			conf.DiscoveryAuth.ClientCa = clientCa(s.conf)
+		}
+	}
+	if err := s.apply(conf); err != nil {
+		log.Printf("reload of %s failed, keeping current configuration: %s", s.opts.configFileLocation, err)
+		return
+	}
+	log.Printf("configuration reloaded from %s", s.opts.configFileLocation)
+}
+
+func clientCa(conf *handler.Configuration) string {
+	if conf.DiscoveryAuth == nil {
+		return ""
+	}
+	return conf.DiscoveryAuth.ClientCa
+}
+
+func (s *server) watch() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	var changes <-chan struct{}
+	if s.opts.watchInterval > 0 {
+		watcher := config.NewWatcher(s.opts.configFileLocation, s.opts.format, s.opts.watchInterval)
+		go watcher.Start()
+		defer watcher.Stop()
+		changes = watcher.Changes
+	}
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-hangup:
+		case <-changes:
+		}
+		s.reload()
+	}
+}
+
+// maxTunnelDrain bounds the wait for upgraded connections when the
+// shutdownTimeout waits indefinitely for in-flight requests.
+const maxTunnelDrain = 30 * time.Second
+
+// shutdown stops the configuration watch, stops accepting connections and
+// waits up to the configured shutdownTimeout for in-flight requests and
+// upgraded connections to complete before closing what is left. It then
+// stops background work and flushes the log file.
+func (s *server) shutdown(httpServer *http.Server) error {
+	close(s.stop)
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	ctx := context.Background()
+	if s.conf.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.conf.ShutdownTimeout)*time.Millisecond)
+		defer cancel()
+	}
+	// Upgraded connections are hijacked and left alone by the HTTP server, so
+	// they are drained alongside the in-flight requests. Idle tunnels may stay
+	// open forever, so they are not waited for indefinitely.
+	tunnelCtx := ctx
+	if s.conf.ShutdownTimeout == 0 {
+		var cancel context.CancelFunc
+		tunnelCtx, cancel = context.WithTimeout(ctx, maxTunnelDrain)
+		defer cancel()
+	}
+	tunnelsClosed := make(chan struct{})
+	httpServer.RegisterOnShutdown(func() {
+		handler.CloseTunnels(tunnelCtx)
+		close(tunnelsClosed)
+	})
+	err := httpServer.Shutdown(ctx)
+	if err == context.DeadlineExceeded {
+		log.Println("WARNING: shutdown timeout reached, closing remaining connections.")
+		err = httpServer.Close()
+	}
+	<-tunnelsClosed
+	s.conf.Close()
+	if s.discoveryService != nil {
+		s.discoveryService.Stop()
+	}
+	if s.logFile != nil {
+		s.logFile.Sync()
+		s.logFile.Close()
+	}
+	return err
+}
+
+func run(conf *handler.Configuration, opts options) error {
+	s := &server{opts: opts, stop: make(chan struct{}), metrics: newMetrics()}
+	if err := s.apply(conf); err != nil {
+		return err
+	}
+	if opts.configFileLocation != "" {
+		go s.watch()
+	}
+	tlsConfig, err := conf.GetServerTLSConfig()
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{
+		Addr:      conf.Listen,
+		Handler:   s,
+		TLSConfig: tlsConfig,
+	}
+	// Discovery watches and long-polls only end once the registry stops, so
+	// it is stopped as soon as the shutdown starts.
+	httpServer.RegisterOnShutdown(func() {
+		s.mu.Lock()
+		discoveryService := s.discoveryService
+		s.mu.Unlock()
+		if discoveryService != nil {
+			discoveryService.Stop()
+		}
+	})
+	addr := conf.Listen
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if conf.ProxyProtocol {
+		ln = conf.NewProxyProtocolListener(ln)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		if conf.Certificate != "" && conf.Key != "" {
+			errs <- httpServer.ServeTLS(ln, conf.Certificate, conf.Key)
+			return
+		}
+		errs <- httpServer.Serve(ln)
+	}()
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-quit:
+		log.Printf("received %s, shutting down", sig)
+	}
+	return s.shutdown(httpServer)
+}
@@ -0,0 +1,291 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aravinth2094/goginx/handler"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	testMetricsOnce sync.Once
+	testMetrics     *metrics
+)
+
+// sharedMetrics sets the global metrics monitor up once for every test.
+func sharedMetrics() *metrics {
+	testMetricsOnce.Do(func() {
+		testMetrics = newMetrics()
+	})
+	return testMetrics
+}
+
+// newTestServer applies the configuration at location the way run does,
+// without listening.
+func newTestServer(t *testing.T, location string) *server {
+	gin.SetMode(gin.TestMode)
+	s := &server{opts: options{configFileLocation: location}, stop: make(chan struct{}), metrics: sharedMetrics()}
+	conf, err := getConfigurationFromFile(location, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.apply(conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.conf.Close()
+		s.logFile.Close()
+		if s.discoveryService != nil {
+			s.discoveryService.Stop()
+		}
+	})
+	return s
+}
+
+func writeTestConfig(t *testing.T, location string, routes string, discovery bool) {
+	content := fmt.Sprintf(`{
+	"listen": ":8080",
+	"log": %q,
+	"discovery": %t,
+	"routes": %s
+}`, filepath.Join(filepath.Dir(location), "goginx.log"), discovery, routes)
+	if err := ioutil.WriteFile(location, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(s *server, target string) int {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w.Code
+}
+
+func TestReloadKeepsConfigurationOnError(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	location := filepath.Join(t.TempDir(), "goginx.json")
+	writeTestConfig(t, location, fmt.Sprintf(`[ { "path": "/", "forwardUrl": %q, "allowedMethods": [ "GET" ] } ]`, upstream.URL), false)
+	s := newTestServer(t, location)
+	current := s.conf
+
+	tests := map[string]string{
+		"invalid":           `[]`,
+		"wildcard conflict": `[ { "path": "/a/:id", "forwardUrl": "http://localhost/", "allowedMethods": [ "GET" ] }, { "path": "/a/*x", "forwardUrl": "http://localhost/", "allowedMethods": [ "GET" ] } ]`,
+		"metrics route":     `[ { "path": "/metrics", "forwardUrl": "http://localhost/", "allowedMethods": [ "GET" ] } ]`,
+	}
+	for name, routes := range tests {
+		writeTestConfig(t, location, routes, false)
+		s.reload()
+		if s.conf != current {
+			t.Errorf("%s: a failed reload must keep the current configuration", name)
+		}
+		if code := get(s, "/"); code != http.StatusOK {
+			t.Errorf("%s: the current engine must keep serving, got %d", name, code)
+		}
+	}
+
+	writeTestConfig(t, location, `[ { "path": "/", "forwardUrl": "svc:/", "allowedMethods": [ "GET" ] } ]`, true)
+	s.reload()
+	if s.conf == current {
+		t.Error("a discovery route with a short forwardUrl must be reloaded")
+	}
+}
+
+func TestBuildEngineRecoversPanic(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := &handler.Configuration{
+		Routes: []handler.Route{
+			{Path: "/a/:id", ForwardUrl: "http://localhost/", AllowedMethods: []string{"GET"}},
+			{Path: "/a/*x", ForwardUrl: "http://localhost/", AllowedMethods: []string{"GET"}},
+		},
+	}
+	defer conf.Close()
+	if _, err := buildEngine(conf, nil, sharedMetrics()); err == nil {
+		t.Error("routes gin refuses must fail to build instead of panicking")
+	}
+}
+
+func freeAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// startServer runs conf until the test sends SIGTERM and returns the base URL
+// of the server once it accepts requests, and the result of run.
+func startServer(t *testing.T, conf *handler.Configuration) (string, chan error) {
+	// The signal is also delivered here so that it never terminates the test
+	// before run listens for it.
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM)
+	t.Cleanup(func() {
+		signal.Stop(terminate)
+	})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- run(conf, options{})
+	}()
+	base := "http://" + conf.Listen
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", conf.Listen); err == nil {
+			conn.Close()
+			return base, stopped
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the server did not start")
+		}
+	}
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	arrived := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer upstream.Close()
+	gin.SetMode(gin.TestMode)
+	conf := &handler.Configuration{
+		Listen:          freeAddress(t),
+		Log:             filepath.Join(t.TempDir(), "goginx.log"),
+		ShutdownTimeout: 5000,
+		Discovery:       true,
+		Routes: []handler.Route{
+			{Path: "/slow", ForwardUrl: upstream.URL, AllowedMethods: []string{"GET"}},
+		},
+	}
+	base, stopped := startServer(t, conf)
+
+	type result struct {
+		body string
+		err  error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		slow <- result{string(body), err}
+	}()
+	polled := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(base + "/discovery?index=0&wait=60000")
+		if err == nil {
+			resp.Body.Close()
+		}
+		polled <- err
+	}()
+	<-arrived
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("shutdown failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the long-poll must not hold the shutdown")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("the shutdown must only wait for the in-flight request, took %v", elapsed)
+	}
+	if r := <-slow; r.err != nil || r.body != "done" {
+		t.Errorf("the in-flight request must complete, got %q %v", r.body, r.err)
+	}
+	if err := <-polled; err != nil {
+		t.Errorf("the long-poll must be answered, got %v", err)
+	}
+}
+
+func TestShutdownClosesTunnels(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	}))
+	defer upstream.Close()
+	gin.SetMode(gin.TestMode)
+	conf := &handler.Configuration{
+		Listen:          freeAddress(t),
+		Log:             filepath.Join(t.TempDir(), "goginx.log"),
+		ShutdownTimeout: 200,
+		Routes: []handler.Route{
+			{Path: "/ws", ForwardUrl: upstream.URL, AllowedMethods: []string{"GET"}},
+		},
+	}
+	_, stopped := startServer(t, conf)
+	conn, err := net.Dial("tcp", conf.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: goginx\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %v %v", resp, err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("an open tunnel must not hold the shutdown past shutdownTimeout")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected the tunnel to be closed, got %v", err)
+	}
+}
+
+func TestMetricsAccess(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "goginx.json")
+	writeTestConfig(t, location, `[ { "path": "/", "forwardUrl": "http://localhost/", "allowedMethods": [ "GET" ] } ]`, false)
+	s := newTestServer(t, location)
+	for name, access := range map[string][]handler.AccessRule{
+		"allowed": {{Allow: "192.0.2.1"}, {Deny: "all"}},
+		"denied":  {{Deny: "192.0.2.1"}},
+	} {
+		conf := *s.conf
+		conf.Access = access
+		engine, err := buildEngine(&conf, nil, s.metrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if name == "denied" && w.Code != http.StatusForbidden {
+			t.Errorf("a denied client must get 403 on /metrics, got %d", w.Code)
+		}
+		if name == "allowed" && w.Code != http.StatusOK {
+			t.Errorf("an allowed client must read /metrics, got %d", w.Code)
+		}
+	}
+}
@@ -3,46 +3,77 @@ package config
 import (
 	"encoding/json"
 	"io/ioutil"
-	"net/http"
+	"reflect"
+	"strings"
 
 	"github.com/aravinth2094/goginx/handler"
 )
 
-func readFileFromLocal(fileLocation string) ([]byte, error) {
-	return ioutil.ReadFile(fileLocation)
+func readFileFromLocal(fileLocation string) ([]byte, string, error) {
+	file, err := ioutil.ReadFile(fileLocation)
+	return file, "", err
 }
 
-func readFileFromUrl(url string) ([]byte, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
-}
-
-func readFile(fileLocation string) ([]byte, error) {
+// read returns the content of a local or remote file together with its
+// Content-Type, which is empty for local files, and whether the file is
+// trusted to read local files: it is local or its signature was verified.
+// Downloaded remote files are kept until the whole configuration is known to
+// be good and can be cached.
+func (l *loader) read(fileLocation string) ([]byte, string, bool, error) {
 	if fileLocation == "" {
-		return nil, nil
+		return nil, "", true, nil
 	}
-	if fileLocation[0:4] == "http" {
-		return readFileFromUrl(fileLocation)
+	if strings.HasPrefix(fileLocation, "http") {
+		file, downloaded, err := readFileFromUrl(fileLocation)
+		if err != nil {
+			return nil, "", false, err
+		}
+		if downloaded {
+			l.downloaded = append(l.downloaded, file)
+		}
+		return file.Body, file.ContentType, remoteFilesVerified(), nil
 	}
-	return readFileFromLocal(fileLocation)
+	file, contentType, err := readFileFromLocal(fileLocation)
+	return file, contentType, true, err
 }
 
 func ParseConfig(configFileLocation string) (*handler.Configuration, error) {
+	return ParseConfigWithFormat(configFileLocation, "")
+}
+
+// ParseConfigWithFormat parses a JSON, YAML or TOML configuration. An empty
+// format is detected from the Content-Type or the file extension.
+func ParseConfigWithFormat(configFileLocation string, format string) (*handler.Configuration, error) {
 	conf := &handler.Configuration{
-		Listen: ":80",
-		Log:    "goginx.log",
+		Listen:          ":80",
+		Log:             "goginx.log",
+		ShutdownTimeout: 30000,
 	}
-	file, err := readFile(configFileLocation)
+	l := newLoader()
+	document, locations, err := l.load(configFileLocation, format)
 	if err != nil {
 		return nil, err
 	}
-	err = json.Unmarshal([]byte(file), &conf)
+	if err := l.include(configFileLocation, document, locations); err != nil {
+		return nil, err
+	}
+	checkFields(document, reflect.TypeOf(conf), "", &l.errs)
+	if len(l.errs) > 0 {
+		return nil, locations.annotate(l.errs)
+	}
+	normalized, err := json.Marshal(document)
 	if err != nil {
 		return nil, err
 	}
+	err = json.Unmarshal(normalized, conf)
+	if err != nil {
+		return nil, err
+	}
+	conf.Locations = handler.Locations(locations)
+	// A broken or half uploaded remote file must not replace the last good
+	// copy used when the server cannot be reached.
+	if len(l.downloaded) > 0 && conf.Validate() == nil {
+		cacheRemoteFiles(l.downloaded)
+	}
 	return conf, nil
 }
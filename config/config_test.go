@@ -0,0 +1,375 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name string, content string) string {
+	location := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(location, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func checkParsedConfig(t *testing.T, location string, format string) {
+	conf, err := ParseConfigWithFormat(location, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Listen != ":80" || conf.Log != "goginx.log" {
+		t.Error("defaults must be kept")
+	}
+	if len(conf.Routes) != 1 || conf.Routes[0].ForwardUrl != "httpbin:/anything" {
+		t.Fatal("routes not parsed")
+	}
+	if conf.Routes[0].CustomHeaders["X-Custom"] != "value" {
+		t.Error("customHeaders not parsed")
+	}
+	if conf.Routes[0].Timeout != 5000 {
+		t.Error("timeout not parsed")
+	}
+	if len(conf.Upstreams["httpbin"].Hosts) != 1 {
+		t.Error("upstreams not parsed")
+	}
+}
+
+func TestParseConfigJSON(t *testing.T) {
+	checkParsedConfig(t, writeConfig(t, "goginx.json", `{
+	"upstreams": { "httpbin": [ "https://httpbin.org" ] },
+	"routes": [
+		{
+			"path": "/search",
+			"forwardUrl": "httpbin:/anything",
+			"allowedMethods": [ "GET" ],
+			"customHeaders": { "X-Custom": "value" },
+			"timeout": 5000
+		}
+	]
+}`), "")
+}
+
+func TestParseConfigYAML(t *testing.T) {
+	checkParsedConfig(t, writeConfig(t, "goginx.yaml", `# gateway
+upstreams:
+  httpbin:
+    - https://httpbin.org
+routes:
+  - path: /search
+    forwardUrl: httpbin:/anything
+    allowedMethods: [GET]
+    customHeaders:
+      X-Custom: value
+    timeout: 5000
+`), "")
+}
+
+func TestParseConfigTOML(t *testing.T) {
+	checkParsedConfig(t, writeConfig(t, "goginx.toml", `# gateway
+[upstreams]
+httpbin = ["https://httpbin.org"]
+
+[[routes]]
+path = "/search"
+forwardUrl = "httpbin:/anything"
+allowedMethods = ["GET"]
+timeout = 5000
+
+[routes.customHeaders]
+X-Custom = "value"
+`), "")
+}
+
+func TestParseConfigFormatOverride(t *testing.T) {
+	checkParsedConfig(t, writeConfig(t, "goginx.conf", `
+upstreams: { httpbin: [ "https://httpbin.org" ] }
+routes:
+  - { path: /search, forwardUrl: "httpbin:/anything", allowedMethods: [GET], customHeaders: { X-Custom: value }, timeout: 5000 }
+`), FormatYAML)
+}
+
+func TestDetectFormat(t *testing.T) {
+	cases := map[[2]string]string{
+		{"goginx.yml", ""}:  FormatYAML,
+		{"goginx.TOML", ""}: FormatTOML,
+		{"goginx.json", ""}: FormatJSON,
+		{"https://example.com/config", "application/yaml"}: FormatYAML,
+		{"https://example.com/config.toml?v=1", ""}:        FormatTOML,
+		{"https://example.com/config", "text/plain"}:       FormatJSON,
+	}
+	for in, expected := range cases {
+		if format := detectFormat(in[0], in[1]); format != expected {
+			t.Errorf("detectFormat(%q, %q) = %s, expected %s", in[0], in[1], format, expected)
+		}
+	}
+}
+
+func TestParseConfigInterpolation(t *testing.T) {
+	secret := writeConfig(t, "token", "s3cr3t\n")
+	os.Setenv("GOGINX_TEST_HOST", "https://httpbin.org")
+	defer os.Unsetenv("GOGINX_TEST_HOST")
+	location := writeConfig(t, "goginx.json", `{
+	"upstreams": { "httpbin": [ "${GOGINX_TEST_HOST}" ] },
+	"routes": [
+		{
+			"path": "/search",
+			"forwardUrl": "httpbin:${GOGINX_TEST_PATH:-/anything}",
+			"allowedMethods": [ "GET" ],
+			"customHeaders": { "Authorization": "Bearer ${file:`+secret+`}", "X-Price": "$$5" }
+		}
+	]
+}`)
+	conf, err := ParseConfig(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Upstreams["httpbin"].Hosts[0].Url != "https://httpbin.org" {
+		t.Error("environment variable not expanded")
+	}
+	if conf.Routes[0].ForwardUrl != "httpbin:/anything" {
+		t.Error("default value not used")
+	}
+	if conf.Routes[0].CustomHeaders["Authorization"] != "Bearer s3cr3t" {
+		t.Error("secret file not expanded")
+	}
+	if conf.Routes[0].CustomHeaders["X-Price"] != "$5" {
+		t.Error("escaped $ not kept")
+	}
+}
+
+func TestParseConfigUnresolvedVariable(t *testing.T) {
+	location := writeConfig(t, "goginx.json", `{
+	"routes": [ { "path": "/", "forwardUrl": "${GOGINX_TEST_UNSET}", "allowedMethods": [ "GET" ] } ]
+}`)
+	_, err := ParseConfig(location)
+	if err == nil {
+		t.Fatal("unresolved variable must fail")
+	}
+	if err.Error() != location+":2:29: routes[0].forwardUrl: unresolved variable ${GOGINX_TEST_UNSET}" {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestParseConfigUnknownFields(t *testing.T) {
+	cases := map[string]string{
+		"goginx.json": `{
+	"routes": [
+		{
+			"path": "/search",
+			"forwardURL": "https://httpbin.org/anything",
+			"allowedMethod": [ "GET" ]
+		}
+	]
+}`,
+		"goginx.yaml": `routes:
+  - path: /search
+    forwardURL: https://httpbin.org/anything
+    allowedMethod: [GET]
+`,
+		"goginx.toml": `[[routes]]
+path = "/search"
+forwardURL = "https://httpbin.org/anything"
+allowedMethod = ["GET"]
+`,
+	}
+	lines := map[string][2]string{
+		"goginx.json": {":5:4", ":6:4"},
+		"goginx.yaml": {":3:5", ":4:5"},
+		"goginx.toml": {":3:1", ":4:1"},
+	}
+	for name, content := range cases {
+		location := writeConfig(t, name, content)
+		_, err := ParseConfig(location)
+		if err == nil {
+			t.Errorf("%s: unknown fields must fail", name)
+			continue
+		}
+		expected := location + lines[name][0] + `: routes[0].forwardURL: unknown field "forwardURL", did you mean "forwardUrl"?` + "\n" +
+			location + lines[name][1] + `: routes[0].allowedMethod: unknown field "allowedMethod", did you mean "allowedMethods"?`
+		if err.Error() != expected {
+			t.Errorf("%s: unexpected error:\n%s\nexpected:\n%s", name, err, expected)
+		}
+	}
+}
+
+func TestParseConfigUpstreamListUnknownField(t *testing.T) {
+	location := writeConfig(t, "goginx.json", `{
+	"upstreams": { "u": [ "http://a", { "url": "http://b", "wieght": 3 } ] },
+	"routes": [ { "path": "/", "forwardUrl": "u:/", "allowedMethods": [ "GET" ] } ]
+}`)
+	_, err := ParseConfig(location)
+	if err == nil || !strings.Contains(err.Error(), `upstreams.u[1].wieght: unknown field "wieght", did you mean "weight"?`) {
+		t.Errorf("unknown fields of list form upstream hosts must fail, got %v", err)
+	}
+}
+
+func TestParseConfigTypeError(t *testing.T) {
+	location := writeConfig(t, "goginx.yaml", `routes:
+  - path: /search
+    timeout: soon
+`)
+	_, err := ParseConfig(location)
+	if err == nil || err.Error() != location+":3:5: routes[0].timeout: expected an integer, found a string" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestParseConfigSyntaxError(t *testing.T) {
+	location := writeConfig(t, "goginx.json", `{
+	"routes": [
+		{ "path": "/search" }
+	],,
+}`)
+	_, err := ParseConfig(location)
+	if err == nil || !strings.HasPrefix(err.Error(), location+":4:4: ") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateLocations(t *testing.T) {
+	location := writeConfig(t, "goginx.json", `{
+	"listen": "",
+	"routes": [
+		{
+			"path": "/search",
+			"forwardUrl": "missing:/anything"
+		}
+	]
+}`)
+	conf, err := ParseConfig(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conf.Validate()
+	expected := location + ":2:2: listen: listen address is not set\n" +
+		location + ":4:3: routes[0].allowedMethods: /search must contain atleast one allowedMethod\n" +
+		location + ":6:4: routes[0].forwardUrl: missing:/anything forwardUrl not in upstream"
+	if err == nil || err.Error() != expected {
+		t.Errorf("unexpected error:\n%v\nexpected:\n%s", err, expected)
+	}
+}
+
+func TestParseConfigInclude(t *testing.T) {
+	location := writeConfig(t, "goginx.json", `{
+	"include": [ "teams/*.yaml" ],
+	"upstreams": { "httpbin": [ "https://httpbin.org" ] },
+	"routes": [
+		{ "path": "/search", "forwardUrl": "httpbin:/anything", "allowedMethods": [ "GET" ] }
+	]
+}`)
+	dir := filepath.Dir(location)
+	os.Mkdir(filepath.Join(dir, "teams"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "teams", "a.yaml"), []byte(`upstreams:
+  httpbin: [ "https://httpbin.org" ]
+  echo: [ "https://echo.example.com" ]
+routes:
+  - path: /echo
+    forwardUrl: echo:/
+    allowedMethods: [ GET ]
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "teams", "b.yaml"), []byte(`routes:
+  - path: /status
+    forwardUrl: httpbin:/status/200
+    allowedMethods: [ GET ]
+`), 0644)
+	conf, err := ParseConfig(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Routes) != 3 || conf.Routes[1].Path != "/echo" || conf.Routes[2].Path != "/status" {
+		t.Fatal("included routes not merged")
+	}
+	if len(conf.Upstreams) != 2 {
+		t.Error("included upstreams not merged")
+	}
+	if source := conf.Locations.Locate("routes[2]"); source != filepath.Join(dir, "teams", "b.yaml")+":2:5" {
+		t.Errorf("unexpected route source %s", source)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseConfigIncludeConflicts(t *testing.T) {
+	location := writeConfig(t, "goginx.json", `{
+	"include": [ "team.yaml" ],
+	"upstreams": { "httpbin": [ "https://httpbin.org" ] },
+	"routes": [
+		{ "path": "/search", "forwardUrl": "httpbin:/anything", "allowedMethods": [ "GET" ] }
+	]
+}`)
+	fragment := filepath.Join(filepath.Dir(location), "team.yaml")
+	ioutil.WriteFile(fragment, []byte(`upstreams:
+  httpbin: [ "https://example.com" ]
+routes:
+  - path: /search
+    forwardUrl: https://example.com/
+    allowedMethods: [ POST, GET ]
+`), 0644)
+	_, err := ParseConfig(location)
+	expected := fragment + `:2:3: upstreams.httpbin: upstream "httpbin" conflicts with the definition at ` + location + ":3:17"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("unexpected error:\n%v\nexpected:\n%s", err, expected)
+	}
+	ioutil.WriteFile(fragment, []byte(`routes:
+  - path: /search
+    forwardUrl: https://example.com/
+    allowedMethods: [ POST, GET ]
+`), 0644)
+	conf, err := ParseConfig(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conf.Validate()
+	expected = fragment + ":2:5: routes[1].path: GET /search is already defined by routes[0] (" + location + ":5:3)"
+	if err == nil || err.Error() != expected {
+		t.Errorf("unexpected error:\n%v\nexpected:\n%s", err, expected)
+	}
+}
+
+func TestParseConfigUpstreamObject(t *testing.T) {
+	location := writeConfig(t, "goginx.yaml", `upstreams:
+  httpbin:
+    hosts:
+      - https://httpbin.org
+      - url: https://eu.httpbin.org
+        weight: 3
+    loadBalancing: weightedRoundRobin
+    maxConnsPerHost: 10
+    dialTimeout: 2000
+  legacy: [ "https://example.com" ]
+routes:
+  - path: /search
+    forwardUrl: httpbin:/anything
+    allowedMethods: [ GET ]
+`)
+	conf, err := ParseConfig(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Upstreams["httpbin"].MaxConnsPerHost != 10 || conf.Upstreams["httpbin"].DialTimeout != 2000 || len(conf.Upstreams["httpbin"].Hosts) != 2 {
+		t.Error("upstream object not parsed")
+	}
+	if conf.Upstreams["httpbin"].Hosts[1].Weight != 3 || conf.Upstreams["httpbin"].LoadBalancing != "weightedRoundRobin" {
+		t.Error("weighted host not parsed")
+	}
+	if len(conf.Upstreams["legacy"].Hosts) != 1 {
+		t.Error("upstream list not parsed")
+	}
+
+	location = writeConfig(t, "goginx.yaml", `upstreams:
+  httpbin:
+    hosts: [ "https://httpbin.org" ]
+    maxConnPerHost: 10
+routes: []
+`)
+	_, err = ParseConfig(location)
+	expected := location + `:4:5: upstreams.httpbin.maxConnPerHost: unknown field "maxConnPerHost", did you mean "maxConnsPerHost"?`
+	if err == nil || err.Error() != expected {
+		t.Errorf("unexpected error:\n%v\nexpected:\n%s", err, expected)
+	}
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// detectFormat picks the configuration format from the Content-Type of a
+// remote configuration and falls back to the file extension, then JSON.
+func detectFormat(fileLocation string, contentType string) string {
+	switch {
+	case strings.Contains(contentType, "yaml"):
+		return FormatYAML
+	case strings.Contains(contentType, "toml"):
+		return FormatTOML
+	case strings.Contains(contentType, "json"):
+		return FormatJSON
+	}
+	if u, err := url.Parse(fileLocation); err == nil && u.Scheme != "" && len(u.Scheme) > 1 {
+		fileLocation = u.Path
+	}
+	switch strings.ToLower(path.Ext(fileLocation)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatJSON
+}
+
+// decode parses a configuration document into a generic tree of
+// map[string]interface{}, []interface{} and scalar values so that every
+// format is mapped onto the same JSON schema of handler.Configuration.
+func decode(file []byte, format string) (interface{}, error) {
+	var tree interface{}
+	switch format {
+	case FormatJSON:
+		decoder := json.NewDecoder(bytes.NewReader(file))
+		decoder.UseNumber()
+		if err := decoder.Decode(&tree); err != nil {
+			return nil, err
+		}
+	case FormatYAML:
+		if err := yaml.Unmarshal(file, &tree); err != nil {
+			return nil, err
+		}
+		tree = normalize(tree)
+	case FormatTOML:
+		table := make(map[string]interface{})
+		if err := toml.Unmarshal(file, &table); err != nil {
+			return nil, err
+		}
+		tree = normalize(table)
+	default:
+		return nil, fmt.Errorf("unsupported configuration format %q", format)
+	}
+	return tree, nil
+}
+
+// normalize converts the map[interface{}]interface{} values produced by YAML
+// mappings with non-string keys and the []map[string]interface{} values
+// produced by TOML arrays of tables into the types encoding/json produces.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprint(key)] = normalize(val)
+		}
+		return m
+	case map[string]interface{}:
+		for key, val := range v {
+			v[key] = normalize(val)
+		}
+	case []map[string]interface{}:
+		array := make([]interface{}, len(v))
+		for i, val := range v {
+			array[i] = normalize(val)
+		}
+		return array
+	case []interface{}:
+		for i, val := range v {
+			v[i] = normalize(val)
+		}
+	}
+	return value
+}
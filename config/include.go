@@ -0,0 +1,181 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aravinth2094/goginx/handler"
+)
+
+// loader reads a configuration document and every document it includes
+// through the include directive, merging their routes and upstreams.
+type loader struct {
+	files      map[string][]byte
+	downloaded []*remoteFile
+	errs       handler.Errors
+}
+
+func newLoader() *loader {
+	return &loader{files: make(map[string][]byte)}
+}
+
+// load reads, decodes and interpolates a single document. Problems that do
+// not prevent decoding are collected in l.errs with their location.
+func (l *loader) load(fileLocation string, format string) (map[string]interface{}, locations, error) {
+	file, contentType, trusted, err := l.read(fileLocation)
+	if err != nil {
+		return nil, nil, err
+	}
+	l.files[fileLocation] = file
+	if format == "" {
+		format = detectFormat(fileLocation, contentType)
+	}
+	tree, err := decode(file, format)
+	if err != nil {
+		return nil, nil, decodeError(fileLocation, file, err)
+	}
+	locations := newLocations(fileLocation, file, format)
+	var errs handler.Errors
+	tree = interpolate(tree, trusted, &errs)
+	l.errs = append(l.errs, locations.annotate(errs)...)
+	document, ok := tree.(map[string]interface{})
+	if !ok {
+		if tree != nil {
+			l.errs = append(l.errs, &handler.FieldError{Location: locations[""], Message: "configuration must be an object"})
+		}
+		document = make(map[string]interface{})
+	}
+	return document, locations, nil
+}
+
+// include merges the documents matched by the include patterns of document
+// into it. Included documents may only hold routes, upstreams and further
+// includes; a file is never included twice.
+func (l *loader) include(fileLocation string, document map[string]interface{}, locs locations) error {
+	patterns, ok := document["include"].([]interface{})
+	if !ok {
+		return nil
+	}
+	for i, pattern := range patterns {
+		path := fmt.Sprintf("include[%d]", i)
+		p, ok := pattern.(string)
+		if !ok {
+			continue
+		}
+		matches, err := resolveInclude(fileLocation, p)
+		if err != nil {
+			l.errs = append(l.errs, &handler.FieldError{Location: locs[path], Path: path, Message: err.Error()})
+			continue
+		}
+		if len(matches) == 0 {
+			l.errs = append(l.errs, &handler.FieldError{Location: locs[path], Path: path, Message: fmt.Sprintf("%s matches no files", p)})
+		}
+		for _, match := range matches {
+			if _, ok := l.files[match]; ok {
+				continue
+			}
+			fragment, fragmentLocs, err := l.load(match, "")
+			if err != nil {
+				return err
+			}
+			if err := l.include(match, fragment, fragmentLocs); err != nil {
+				return err
+			}
+			l.merge(document, locs, fragment, fragmentLocs)
+		}
+	}
+	return nil
+}
+
+func (l *loader) merge(document map[string]interface{}, locs locations, fragment map[string]interface{}, fragmentLocs locations) {
+	for _, key := range sortedKeys(fragment) {
+		switch key {
+		case "include":
+		case "routes":
+			routes, _ := document["routes"].([]interface{})
+			fragmentRoutes, ok := fragment["routes"].([]interface{})
+			if !ok {
+				l.errs = append(l.errs, &handler.FieldError{Location: fragmentLocs["routes"], Path: "routes", Message: "expected an array"})
+				continue
+			}
+			for i := range fragmentRoutes {
+				locs.copy(fragmentLocs, fmt.Sprintf("routes[%d]", i), fmt.Sprintf("routes[%d]", len(routes)+i))
+			}
+			document["routes"] = append(routes, fragmentRoutes...)
+		case "upstreams":
+			upstreams, _ := document["upstreams"].(map[string]interface{})
+			if upstreams == nil {
+				upstreams = make(map[string]interface{})
+				document["upstreams"] = upstreams
+			}
+			fragmentUpstreams, ok := fragment["upstreams"].(map[string]interface{})
+			if !ok {
+				l.errs = append(l.errs, &handler.FieldError{Location: fragmentLocs["upstreams"], Path: "upstreams", Message: "expected an object"})
+				continue
+			}
+			for _, name := range sortedKeys(fragmentUpstreams) {
+				path := joinPath("upstreams", name)
+				if existing, ok := upstreams[name]; ok {
+					if !reflect.DeepEqual(existing, fragmentUpstreams[name]) {
+						l.errs = append(l.errs, &handler.FieldError{
+							Location: fragmentLocs[path],
+							Path:     path,
+							Message:  fmt.Sprintf("upstream %q conflicts with the definition at %s", name, locs[path]),
+						})
+					}
+					continue
+				}
+				upstreams[name] = fragmentUpstreams[name]
+				locs.copy(fragmentLocs, path, path)
+			}
+		default:
+			l.errs = append(l.errs, &handler.FieldError{
+				Location: fragmentLocs[key],
+				Path:     key,
+				Message:  "only include, routes and upstreams are allowed in included files",
+			})
+		}
+	}
+}
+
+// copy adds the locations of from and its children in src as the locations
+// of to and its children.
+func (locs locations) copy(src locations, from string, to string) {
+	for path, location := range src {
+		if path == from || strings.HasPrefix(path, from+".") || strings.HasPrefix(path, from+"[") {
+			locs[to+path[len(from):]] = location
+		}
+	}
+}
+
+// resolveInclude expands an include pattern relative to the including file.
+// Local patterns may use globs; remote locations are used as they are.
+func resolveInclude(fileLocation string, pattern string) ([]string, error) {
+	if strings.HasPrefix(pattern, "http") {
+		return []string{pattern}, nil
+	}
+	if strings.HasPrefix(fileLocation, "http") {
+		base, err := url.Parse(fileLocation)
+		if err != nil {
+			return nil, err
+		}
+		reference, err := url.Parse(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return []string{base.ResolveReference(reference).String()}, nil
+	}
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(fileLocation), pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aravinth2094/goginx/handler"
+)
+
+// interpolate expands ${VAR}, ${VAR:-default} and ${file:/path} references in
+// every string value of the configuration tree. $$ escapes a literal $.
+// ${file:} references are only expanded when readFiles is set, so that a
+// document that is not trusted can not read local files. References that
+// cannot be resolved are reported with the JSON path of the value that
+// contains them.
+func interpolate(tree interface{}, readFiles bool, errs *handler.Errors) interface{} {
+	return interpolateValue(tree, "", readFiles, errs)
+}
+
+func interpolateValue(value interface{}, path string, readFiles bool, errs *handler.Errors) interface{} {
+	switch v := value.(type) {
+	case string:
+		expanded, err := expand(v, readFiles)
+		if err != nil {
+			*errs = append(*errs, &handler.FieldError{Path: path, Message: err.Error()})
+			return v
+		}
+		return expanded
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			v[key] = interpolateValue(v[key], joinPath(path, key), readFiles, errs)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = interpolateValue(val, fmt.Sprintf("%s[%d]", path, i), readFiles, errs)
+		}
+	}
+	return value
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func expand(value string, readFiles bool) (string, error) {
+	if !strings.Contains(value, "$") {
+		return value, nil
+	}
+	var expanded strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '$' || i+1 == len(value) {
+			expanded.WriteByte(value[i])
+			continue
+		}
+		switch value[i+1] {
+		case '$':
+			expanded.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(value[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated reference in %q", value)
+			}
+			resolved, err := resolve(value[i+2:i+end], readFiles)
+			if err != nil {
+				return "", err
+			}
+			expanded.WriteString(resolved)
+			i += end
+		default:
+			expanded.WriteByte('$')
+		}
+	}
+	return expanded.String(), nil
+}
+
+func resolve(reference string, readFiles bool) (string, error) {
+	if strings.HasPrefix(reference, "file:") {
+		if !readFiles {
+			return "", fmt.Errorf("${%s} is only allowed in local or signature verified configuration files", reference)
+		}
+		secret, err := ioutil.ReadFile(reference[len("file:"):])
+		if err != nil {
+			return "", fmt.Errorf("unresolved ${%s}: %s", reference, err)
+		}
+		return strings.TrimRight(string(secret), "\r\n"), nil
+	}
+	name, fallback, hasFallback := reference, "", false
+	if i := strings.Index(reference, ":-"); i >= 0 {
+		name, fallback, hasFallback = reference[:i], reference[i+2:], true
+	}
+	if name == "" {
+		return "", fmt.Errorf("empty reference ${%s}", reference)
+	}
+	if value, ok := os.LookupEnv(name); ok && (value != "" || !hasFallback) {
+		return value, nil
+	}
+	if hasFallback {
+		return fallback, nil
+	}
+	return "", fmt.Errorf("unresolved variable ${%s}", name)
+}
@@ -0,0 +1,231 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/aravinth2094/goginx/handler"
+	"gopkg.in/yaml.v3"
+)
+
+// locations maps the JSON path of every value in a configuration document
+// to the file:line:column it was read from.
+type locations handler.Locations
+
+func newLocations(fileLocation string, file []byte, format string) locations {
+	l := make(locations)
+	switch format {
+	case FormatJSON:
+		l.json(fileLocation, file)
+	case FormatYAML:
+		var document yaml.Node
+		if yaml.Unmarshal(file, &document) == nil && len(document.Content) > 0 {
+			l.yaml(fileLocation, document.Content[0], "")
+		}
+	case FormatTOML:
+		l.toml(fileLocation, file)
+	}
+	return l
+}
+
+func offsetLocation(fileLocation string, file []byte, offset int64) string {
+	if offset > int64(len(file)) {
+		offset = int64(len(file))
+	}
+	line := bytes.Count(file[:offset], []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(file[:offset], '\n')
+	return fmt.Sprintf("%s:%d:%d", fileLocation, line, column)
+}
+
+func (l locations) json(fileLocation string, file []byte) {
+	decoder := json.NewDecoder(bytes.NewReader(file))
+	// next returns the offset of the next token, skipping the separators the
+	// decoder consumes implicitly.
+	next := func() int64 {
+		offset := decoder.InputOffset()
+		for offset < int64(len(file)) && strings.IndexByte(" \t\r\n,:", file[offset]) >= 0 {
+			offset++
+		}
+		return offset
+	}
+	var value func(path string) error
+	value = func(path string) error {
+		l[path] = offsetLocation(fileLocation, file, next())
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'):
+			for decoder.More() {
+				keyOffset := next()
+				key, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				keyPath := joinPath(path, fmt.Sprint(key))
+				if err := value(keyPath); err != nil {
+					return err
+				}
+				l[keyPath] = offsetLocation(fileLocation, file, keyOffset)
+			}
+			_, err = decoder.Token()
+		case json.Delim('['):
+			for i := 0; decoder.More(); i++ {
+				if err := value(fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+			_, err = decoder.Token()
+		}
+		return err
+	}
+	value("")
+}
+
+func (l locations) yaml(fileLocation string, node *yaml.Node, path string) {
+	l[path] = fmt.Sprintf("%s:%d:%d", fileLocation, node.Line, node.Column)
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			keyPath := joinPath(path, key.Value)
+			l.yaml(fileLocation, node.Content[i+1], keyPath)
+			l[keyPath] = fmt.Sprintf("%s:%d:%d", fileLocation, key.Line, key.Column)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			l.yaml(fileLocation, item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+var (
+	tomlTable     = regexp.MustCompile(`^\s*(\[\[?)\s*([^\]]+?)\s*\]\]?`)
+	yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+	tomlKey       = regexp.MustCompile(`^(\s*)("[^"]*"|'[^']*'|[A-Za-z0-9_.-]+)\s*=`)
+)
+
+// toml locates table headers and key/value lines. The TOML decoder does not
+// expose positions, so values inside inline tables are located at the line
+// of the key that holds them.
+func (l locations) toml(fileLocation string, file []byte) {
+	arrays := make(map[string]int)
+	table := ""
+	for n, line := range strings.Split(string(file), "\n") {
+		if match := tomlTable.FindStringSubmatch(line); match != nil {
+			location := fmt.Sprintf("%s:%d:%d", fileLocation, n+1, 1)
+			keys := splitTOMLKey(match[2])
+			arrayHeader := match[1] == "[["
+			table = ""
+			for i, key := range keys {
+				table = joinPath(table, key)
+				if index, ok := arrays[table]; ok && !(arrayHeader && i == len(keys)-1) {
+					table = fmt.Sprintf("%s[%d]", table, index)
+				}
+			}
+			if arrayHeader {
+				index := 0
+				if last, ok := arrays[table]; ok {
+					index = last + 1
+				}
+				arrays[table] = index
+				l[table] = location
+				table = fmt.Sprintf("%s[%d]", table, index)
+			}
+			l[table] = location
+			continue
+		}
+		if match := tomlKey.FindStringSubmatch(line); match != nil {
+			path := table
+			for _, key := range splitTOMLKey(match[2]) {
+				path = joinPath(path, key)
+			}
+			l[path] = fmt.Sprintf("%s:%d:%d", fileLocation, n+1, len(match[1])+1)
+		}
+	}
+}
+
+func splitTOMLKey(key string) []string {
+	var keys []string
+	for _, part := range strings.Split(key, ".") {
+		keys = append(keys, strings.Trim(strings.TrimSpace(part), `"'`))
+	}
+	return keys
+}
+
+// annotate sets the location of every FieldError that does not have one yet
+// and orders the errors as they appear in the file.
+func (l locations) annotate(errs handler.Errors) handler.Errors {
+	for _, err := range errs {
+		if fieldErr, ok := err.(*handler.FieldError); ok && fieldErr.Location == "" {
+			fieldErr.Location = handler.Locations(l).Locate(fieldErr.Path)
+		}
+	}
+	files := make(map[string]int)
+	for _, err := range errs {
+		file, _ := position(err)
+		if _, ok := files[file]; !ok {
+			files[file] = len(files)
+		}
+	}
+	sort.SliceStable(errs, func(i, j int) bool {
+		fileI, lineColumnI := position(errs[i])
+		fileJ, lineColumnJ := position(errs[j])
+		if fileI != fileJ {
+			return files[fileI] < files[fileJ]
+		}
+		return lineColumnI < lineColumnJ
+	})
+	return errs
+}
+
+// position splits the location of a FieldError into its file and a sortable
+// line and column.
+func position(err error) (string, int) {
+	fieldErr, ok := err.(*handler.FieldError)
+	if !ok {
+		return "", 0
+	}
+	parts := strings.Split(fieldErr.Location, ":")
+	if len(parts) < 3 {
+		return fieldErr.Location, 0
+	}
+	line, _ := strconv.Atoi(parts[len(parts)-2])
+	column, _ := strconv.Atoi(parts[len(parts)-1])
+	return strings.Join(parts[:len(parts)-2], ":"), line<<16 + column
+}
+
+// decodeError reports a syntax error at the file:line:column it occurred.
+func decodeError(fileLocation string, file []byte, err error) error {
+	location := fileLocation
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		location = offsetLocation(fileLocation, file, e.Offset-1)
+	case *json.UnmarshalTypeError:
+		location = offsetLocation(fileLocation, file, e.Offset)
+	case toml.ParseError:
+		location = offsetLocation(fileLocation, file, int64(e.Position.Start))
+		err = errors.New(e.Message)
+	case *yaml.TypeError:
+		err = errors.New(strings.Join(e.Errors, "; "))
+	default:
+		if match := yamlErrorLine.FindStringSubmatch(err.Error()); match != nil {
+			location = fmt.Sprintf("%s:%s", fileLocation, match[1])
+			err = errors.New(match[2])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			location = offsetLocation(fileLocation, file, int64(len(file)))
+			err = errors.New("unexpected end of configuration")
+		}
+	}
+	return &handler.FieldError{Location: location, Message: err.Error()}
+}
@@ -0,0 +1,278 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemoteOptions controls how remote configuration files are fetched.
+type RemoteOptions struct {
+	// Timeout bounds every request for a configuration or signature file.
+	Timeout time.Duration
+	// PublicKey, when set, requires every remote configuration file to have
+	// a detached Ed25519 signature at the same URL with a .sig suffix.
+	PublicKey ed25519.PublicKey
+	// CacheDir keeps the last good copy of every remote configuration file,
+	// used when the server cannot be reached. Empty disables the cache.
+	CacheDir string
+}
+
+// remoteFile is the last good copy of a remote configuration file.
+type remoteFile struct {
+	Url         string `json:"url"`
+	ETag        string `json:"etag"`
+	ContentType string `json:"contentType"`
+	Body        []byte `json:"body"`
+	Signature   []byte `json:"signature"`
+}
+
+var (
+	remoteOptions = RemoteOptions{Timeout: 10 * time.Second}
+	remoteMu      sync.Mutex
+	remoteFiles   = make(map[string]*remoteFile)
+	remoteOffline = make(map[string]bool)
+)
+
+func SetRemoteOptions(opts RemoteOptions) {
+	remoteMu.Lock()
+	defer remoteMu.Unlock()
+	remoteOptions = opts
+}
+
+// ReadPublicKey reads an Ed25519 public key stored as PEM (PKIX), base64 or
+// raw bytes.
+func ReadPublicKey(fileLocation string) (ed25519.PublicKey, error) {
+	file, err := ioutil.ReadFile(fileLocation)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(file); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an Ed25519 public key", fileLocation)
+		}
+		return publicKey, nil
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(file))); err == nil {
+		file = decoded
+	}
+	if len(file) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s is not an Ed25519 public key", fileLocation)
+	}
+	return ed25519.PublicKey(file), nil
+}
+
+func fetch(client *http.Client, url string, etag string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusNotModified && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: unexpected status %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+// readSignature reads the signature of the file at location, found at the
+// same URL with a .sig suffix added to its path so that query strings, such
+// as the ones of presigned URLs, are kept.
+func readSignature(client *http.Client, location string) ([]byte, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	u.Path += ".sig"
+	u.RawPath = ""
+	resp, err := fetch(client, u.String(), "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	signature, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature))); err == nil {
+		signature = decoded
+	}
+	return signature, nil
+}
+
+func verify(publicKey ed25519.PublicKey, file *remoteFile) error {
+	if publicKey == nil {
+		return nil
+	}
+	if len(file.Signature) != ed25519.SignatureSize || !ed25519.Verify(publicKey, file.Body, file.Signature) {
+		return fmt.Errorf("%s: signature verification failed", file.Url)
+	}
+	return nil
+}
+
+func cacheFileLocation(cacheDir string, url string) string {
+	return filepath.Join(cacheDir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(url))))
+}
+
+func writeCache(cacheDir string, file *remoteFile) error {
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	location := cacheFileLocation(cacheDir, file.Url)
+	if err := ioutil.WriteFile(location+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(location+".tmp", location)
+}
+
+func readCache(cacheDir string, url string) (*remoteFile, error) {
+	data, err := ioutil.ReadFile(cacheFileLocation(cacheDir, url))
+	if err != nil {
+		return nil, err
+	}
+	file := &remoteFile{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// remoteFilesVerified reports whether every remote configuration file is
+// signature verified.
+func remoteFilesVerified() bool {
+	remoteMu.Lock()
+	defer remoteMu.Unlock()
+	return remoteOptions.PublicKey != nil
+}
+
+// cacheRemoteFiles keeps files on disk as the last good copies used when
+// their server cannot be reached. It is called once the configuration they
+// make up has been parsed and validated.
+func cacheRemoteFiles(files []*remoteFile) {
+	remoteMu.Lock()
+	cacheDir := remoteOptions.CacheDir
+	remoteMu.Unlock()
+	if cacheDir == "" {
+		return
+	}
+	for _, file := range files {
+		if err := writeCache(cacheDir, file); err != nil {
+			log.Printf("WARNING: could not cache %s: %s", file.Url, err)
+		}
+	}
+}
+
+// readFileFromUrl fetches a remote configuration file and reports whether it
+// was downloaded. Unchanged files are answered from memory through
+// If-None-Match. When the server cannot be reached or answers with an error
+// status, the last good copy cached on disk is used instead.
+func readFileFromUrl(url string) (*remoteFile, bool, error) {
+	remoteMu.Lock()
+	opts := remoteOptions
+	cached := remoteFiles[url]
+	remoteMu.Unlock()
+
+	file, err := fetchRemoteFile(opts, url, cached)
+	if err == nil {
+		remoteMu.Lock()
+		remoteFiles[url] = file
+		if remoteOffline[url] {
+			log.Printf("remote configuration %s is reachable again", url)
+			delete(remoteOffline, url)
+		}
+		remoteMu.Unlock()
+		return file, file != cached, nil
+	}
+	var verifyErr *verificationError
+	if opts.CacheDir == "" || errors.As(err, &verifyErr) {
+		return nil, false, err
+	}
+	file, cacheErr := readCache(opts.CacheDir, url)
+	if cacheErr != nil {
+		return nil, false, err
+	}
+	if err := verify(opts.PublicKey, file); err != nil {
+		return nil, false, err
+	}
+	remoteMu.Lock()
+	if !remoteOffline[url] {
+		log.Printf("WARNING: %s, using the cached copy from %s", err, opts.CacheDir)
+		remoteOffline[url] = true
+	}
+	remoteMu.Unlock()
+	return file, false, nil
+}
+
+// verificationError is a signature failure. The cached copy is not used in
+// its place so a tampered file is never silently replaced.
+type verificationError struct {
+	err error
+}
+
+func (e *verificationError) Error() string {
+	return e.err.Error()
+}
+
+func fetchRemoteFile(opts RemoteOptions, url string, cached *remoteFile) (*remoteFile, error) {
+	client := &http.Client{Timeout: opts.Timeout}
+	etag := ""
+	if cached != nil {
+		etag = cached.ETag
+	}
+	resp, err := fetch(client, url, etag)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	file := &remoteFile{
+		Url:         url,
+		ETag:        resp.Header.Get("ETag"),
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        body,
+	}
+	if opts.PublicKey != nil {
+		if file.Signature, err = readSignature(client, url); err != nil {
+			return nil, err
+		}
+		if err := verify(opts.PublicKey, file); err != nil {
+			return nil, &verificationError{err}
+		}
+	}
+	return file, nil
+}
@@ -0,0 +1,174 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const remoteConfig = `{ "routes": [ { "path": "/", "forwardUrl": "https://httpbin.org/anything", "allowedMethods": [ "GET" ] } ] }`
+
+func TestReadFileFromUrlStatus(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	SetRemoteOptions(RemoteOptions{Timeout: time.Second})
+	if _, err := ParseConfig(server.URL + "/goginx.json"); err == nil {
+		t.Error("a 404 page must not be parsed as configuration")
+	}
+}
+
+func TestReadFileFromUrlETag(t *testing.T) {
+	requests, notModified := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(remoteConfig))
+	}))
+	defer server.Close()
+	SetRemoteOptions(RemoteOptions{Timeout: time.Second})
+	for i := 0; i < 2; i++ {
+		conf, err := ParseConfig(server.URL + "/goginx.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(conf.Routes) != 1 {
+			t.Error("routes not parsed")
+		}
+	}
+	if requests != 2 || notModified != 1 {
+		t.Errorf("expected a conditional second request, got %d requests and %d not modified", requests, notModified)
+	}
+}
+
+func TestReadFileFromUrlSignature(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(remoteConfig)))
+	body := remoteConfig
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/goginx.json.sig" {
+			w.Write([]byte(signature))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	cacheDir := t.TempDir()
+	SetRemoteOptions(RemoteOptions{Timeout: time.Second, PublicKey: publicKey, CacheDir: cacheDir})
+	defer SetRemoteOptions(RemoteOptions{Timeout: time.Second})
+	if _, err := ParseConfig(server.URL + "/goginx.json"); err != nil {
+		t.Fatal(err)
+	}
+	body = remoteConfig + " "
+	if _, err := ParseConfig(server.URL + "/goginx.json"); err == nil {
+		t.Error("a tampered configuration must be rejected")
+	}
+
+	url := server.URL + "/goginx.json"
+	server.Close()
+	remoteMu.Lock()
+	delete(remoteFiles, url)
+	remoteMu.Unlock()
+	conf, err := ParseConfig(url)
+	if err != nil {
+		t.Fatalf("the cached copy must be used when the server is down: %s", err)
+	}
+	if len(conf.Routes) != 1 {
+		t.Error("cached routes not parsed")
+	}
+}
+
+func TestReadFileFromUrlCachesValidConfiguration(t *testing.T) {
+	body := remoteConfig
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	SetRemoteOptions(RemoteOptions{Timeout: time.Second, CacheDir: t.TempDir()})
+	defer SetRemoteOptions(RemoteOptions{Timeout: time.Second})
+	url := server.URL + "/goginx.json"
+	if _, err := ParseConfig(url); err != nil {
+		t.Fatal(err)
+	}
+	for _, broken := range []string{`{ "routes": [ { "path": "/", `, `{ "routes": [] }`} {
+		body = broken
+		if conf, err := ParseConfig(url); err == nil && conf.Validate() == nil {
+			t.Fatalf("%s must not be a valid configuration", broken)
+		}
+	}
+
+	server.Close()
+	remoteMu.Lock()
+	delete(remoteFiles, url)
+	remoteMu.Unlock()
+	conf, err := ParseConfig(url)
+	if err != nil {
+		t.Fatalf("the cached copy must be used when the server is down: %s", err)
+	}
+	if len(conf.Routes) != 1 {
+		t.Error("a broken configuration must not replace the last good copy")
+	}
+}
+
+func TestReadFileFromUrlSignatureQuery(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(remoteConfig)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/goginx.json.sig" {
+			w.Write([]byte(signature))
+			return
+		}
+		w.Write([]byte(remoteConfig))
+	}))
+	defer server.Close()
+	SetRemoteOptions(RemoteOptions{Timeout: time.Second, PublicKey: publicKey})
+	defer SetRemoteOptions(RemoteOptions{Timeout: time.Second})
+	if _, err := ParseConfig(server.URL + "/goginx.json?token=secret"); err != nil {
+		t.Errorf("the signature must be read next to a URL with a query string: %s", err)
+	}
+}
+
+func TestReadFileFromUrlFileInterpolation(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(secret, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	body := `{ "routes": [ { "path": "/", "forwardUrl": "https://httpbin.org/anything", "allowedMethods": [ "GET" ], "customHeaders": { "Authorization": "${file:` + secret + `}" } } ] }`
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/goginx.json.sig" {
+			w.Write(ed25519.Sign(privateKey, []byte(body)))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	defer SetRemoteOptions(RemoteOptions{Timeout: time.Second})
+
+	SetRemoteOptions(RemoteOptions{Timeout: time.Second})
+	if _, err := ParseConfig(server.URL + "/goginx.json"); err == nil || !strings.Contains(err.Error(), "signature verified") {
+		t.Errorf("an unverified remote file must not read local files, got %v", err)
+	}
+	SetRemoteOptions(RemoteOptions{Timeout: time.Second, PublicKey: publicKey})
+	conf, err := ParseConfig(server.URL + "/goginx.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := conf.Routes[0].CustomHeaders["Authorization"]; value != "s3cr3t" {
+		t.Errorf("a verified remote file must read local files, got %q", value)
+	}
+}
@@ -0,0 +1,193 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aravinth2094/goginx/handler"
+)
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// shorthands maps the types with their own decoding to the schema of their
+// shorthand form, such as the list of hosts of an upstream.
+var shorthands = map[reflect.Type]reflect.Type{
+	reflect.TypeOf(handler.Upstream{}): reflect.TypeOf([]handler.UpstreamHost{}),
+}
+
+// checkFields walks the configuration tree against the JSON schema of t and
+// reports unknown keys (matched case-sensitively) and values of the wrong
+// type, so that typos are rejected instead of silently ignored.
+func checkFields(value interface{}, t reflect.Type, path string, errs *handler.Errors) {
+	if value == nil {
+		return
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// Types with their own decoding are checked in their object form and
+	// against the schema of their shorthand, if any.
+	if _, object := value.(map[string]interface{}); reflect.PtrTo(t).Implements(unmarshalerType) && !(object && t.Kind() == reflect.Struct) {
+		if shorthand, ok := shorthands[t]; ok {
+			checkFields(value, shorthand, path, errs)
+		}
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			*errs = append(*errs, typeError(path, "an object", value))
+			return
+		}
+		fields := jsonFields(t)
+		for _, key := range sortedKeys(object) {
+			keyPath := joinPath(path, key)
+			field, ok := fields[key]
+			if !ok {
+				*errs = append(*errs, unknownFieldError(keyPath, key, fields))
+				continue
+			}
+			checkFields(object[key], field.Type, keyPath, errs)
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			*errs = append(*errs, typeError(path, "an object", value))
+			return
+		}
+		for _, key := range sortedKeys(object) {
+			checkFields(object[key], t.Elem(), joinPath(path, key), errs)
+		}
+	case reflect.Slice, reflect.Array:
+		array, ok := value.([]interface{})
+		if !ok {
+			*errs = append(*errs, typeError(path, "an array", value))
+			return
+		}
+		for i, item := range array {
+			checkFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			*errs = append(*errs, typeError(path, "a string", value))
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			*errs = append(*errs, typeError(path, "a boolean", value))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if !isInteger(value) {
+			*errs = append(*errs, typeError(path, "an integer", value))
+		}
+	case reflect.Float32, reflect.Float64:
+		if !isInteger(value) {
+			if _, ok := value.(float64); !ok {
+				*errs = append(*errs, typeError(path, "a number", value))
+			}
+		}
+	}
+}
+
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+func isInteger(value interface{}) bool {
+	switch v := value.(type) {
+	case json.Number:
+		_, err := v.Int64()
+		return err == nil
+	case int, int64, uint64:
+		return true
+	case float64:
+		return v == math.Trunc(v)
+	}
+	return false
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func typeError(path string, expected string, value interface{}) error {
+	kind := "a " + reflect.TypeOf(value).Kind().String()
+	switch value.(type) {
+	case string:
+		kind = "a string"
+	case bool:
+		kind = "a boolean"
+	case json.Number, int, int64, uint64, float64:
+		kind = "a number"
+	case []interface{}:
+		kind = "an array"
+	case map[string]interface{}:
+		kind = "an object"
+	}
+	return &handler.FieldError{Path: path, Message: fmt.Sprintf("expected %s, found %s", expected, kind)}
+}
+
+func unknownFieldError(path string, key string, fields map[string]reflect.StructField) error {
+	message := fmt.Sprintf("unknown field %q", key)
+	suggestion, best := "", 3
+	for name := range fields {
+		if distance := editDistance(strings.ToLower(name), strings.ToLower(key)); distance < best || (distance == best && name < suggestion) {
+			suggestion, best = name, distance
+		}
+	}
+	if suggestion != "" {
+		message += fmt.Sprintf(", did you mean %q?", suggestion)
+	}
+	return &handler.FieldError{Path: path, Message: message}
+}
+
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
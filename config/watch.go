@@ -0,0 +1,92 @@
+package config
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Watcher polls a configuration location and the files it includes and
+// signals on Changes whenever their content differs from the previous poll.
+type Watcher struct {
+	Changes     chan struct{}
+	location    string
+	format      string
+	interval    time.Duration
+	fingerprint string
+	lastError   string
+	stop        chan struct{}
+}
+
+func NewWatcher(location string, format string, interval time.Duration) *Watcher {
+	w := &Watcher{
+		Changes:  make(chan struct{}, 1),
+		location: location,
+		format:   format,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+	w.fingerprint, _ = w.poll()
+	return w
+}
+
+func (w *Watcher) poll() (string, error) {
+	l := newLoader()
+	document, locations, err := l.load(w.location, w.format)
+	if err != nil {
+		return "", err
+	}
+	if err := l.include(w.location, document, locations); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	for _, location := range sortedFiles(l.files) {
+		fmt.Fprintf(hash, "%s\x00%d\x00", location, len(l.files[location]))
+		hash.Write(l.files[location])
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+func sortedFiles(files map[string][]byte) []string {
+	locations := make([]string, 0, len(files))
+	for location := range files {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	return locations
+}
+
+func (w *Watcher) Start() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			fingerprint, err := w.poll()
+			if err != nil {
+				if err.Error() != w.lastError {
+					log.Printf("config watch %s: %s", w.location, err)
+					w.lastError = err.Error()
+				}
+				continue
+			}
+			w.lastError = ""
+			if fingerprint == w.fingerprint {
+				continue
+			}
+			w.fingerprint = fingerprint
+			select {
+			case w.Changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (w *Watcher) Stop() {
+	close(w.stop)
+}
@@ -3,6 +3,7 @@ module github.com/aravinth2094/goginx
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/gin-contrib/cache v1.1.0
 	github.com/gin-contrib/gzip v0.0.3
 	github.com/gin-contrib/timeout v0.0.2
@@ -10,7 +11,6 @@ require (
 	github.com/gin-gonic/gin v1.7.4
 	github.com/go-playground/validator/v10 v10.9.0 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
-	github.com/hlts2/round-robin v0.0.0-20210825114102-ed603bc89ca0
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
 	github.com/penglongli/gin-metrics v0.1.6
@@ -21,4 +21,5 @@ require (
 	golang.org/x/text v0.3.7 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
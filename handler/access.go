@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// accessRule is an AccessRule with its range parsed.
+type accessRule struct {
+	allow    bool
+	networks []*net.IPNet
+}
+
+// accessList is an ordered list of access rules. Clients that match no rule
+// are allowed.
+type accessList []accessRule
+
+func parseAccessRange(value string) ([]*net.IPNet, error) {
+	if value == "all" {
+		return parseCIDRs([]string{"0.0.0.0/0", "::/0"})
+	}
+	return parseCIDRs([]string{value})
+}
+
+func compileAccessRules(rules []AccessRule) (accessList, error) {
+	list := make(accessList, 0, len(rules))
+	for i, rule := range rules {
+		if (rule.Allow == "") == (rule.Deny == "") {
+			return nil, fmt.Errorf("access[%d]: exactly one of allow and deny must be set", i)
+		}
+		value := rule.Allow
+		if value == "" {
+			value = rule.Deny
+		}
+		networks, err := parseAccessRange(value)
+		if err != nil {
+			return nil, fmt.Errorf("access[%d]: %w", i, err)
+		}
+		list = append(list, accessRule{allow: rule.Allow != "", networks: networks})
+	}
+	return list, nil
+}
+
+func validateAccessRules(conf *Configuration, path string, rules []AccessRule) Errors {
+	var errs Errors
+	for i, rule := range rules {
+		rulePath := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case (rule.Allow == "") == (rule.Deny == ""):
+			errs = append(errs, conf.fieldError(rulePath, "exactly one of allow and deny must be set"))
+		case rule.Allow != "":
+			if _, err := parseAccessRange(rule.Allow); err != nil {
+				errs = append(errs, conf.fieldError(rulePath+".allow", err.Error()))
+			}
+		default:
+			if _, err := parseAccessRange(rule.Deny); err != nil {
+				errs = append(errs, conf.fieldError(rulePath+".deny", err.Error()))
+			}
+		}
+	}
+	return errs
+}
+
+// allowed reports whether ip passes the list.
+func (l accessList) allowed(ip net.IP) bool {
+	for _, rule := range l {
+		if containsIP(rule.networks, ip) {
+			return rule.allow
+		}
+	}
+	return true
+}
+
+func (l accessList) handler(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := net.ParseIP(c.ClientIP())
+		if ip != nil && l.allowed(ip) {
+			return
+		}
+		log.Printf("access denied to %s for %s %s by the %s rules", c.ClientIP(), c.Request.Method, c.Request.URL.Path, scope)
+		incMetric(metricAccessDenied, scope)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": c.ClientIP() + " is not allowed"})
+	}
+}
+
+// GetAccessHandler checks the client IP against the top level access rules
+// followed by the whiteList, which allows the listed clients and denies
+// every other one.
+func (conf Configuration) GetAccessHandler() gin.HandlerFunc {
+	rules := append([]AccessRule{}, conf.Access...)
+	for _, entry := range conf.WhiteList {
+		rules = append(rules, AccessRule{Allow: entry})
+	}
+	if len(conf.WhiteList) > 0 {
+		rules = append(rules, AccessRule{Deny: "all"})
+	}
+	list, _ := compileAccessRules(rules)
+	return list.handler("global")
+}
+
+// GetAccessHandler checks the client IP against the access rules of the
+// route, after the top level ones.
+func (route Route) GetAccessHandler() gin.HandlerFunc {
+	list, _ := compileAccessRules(route.Access)
+	return list.handler(route.Path)
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAccessList(t *testing.T) {
+	list, err := compileAccessRules([]AccessRule{
+		{Deny: "10.0.0.13"},
+		{Allow: "10.0.0.0/8"},
+		{Allow: "2001:db8::/32"},
+		{Deny: "all"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"10.0.0.13":       false,
+		"10.1.2.3":        true,
+		"2001:db8::1":     true,
+		"::ffff:10.1.2.3": true,
+		"192.168.1.1":     false,
+		"2001:db9::1":     false,
+	}
+	for ip, expected := range tests {
+		if list.allowed(net.ParseIP(ip)) != expected {
+			t.Errorf("%s: expected allowed %t", ip, expected)
+		}
+	}
+	if !(accessList{}).allowed(net.ParseIP("192.168.1.1")) {
+		t.Error("clients matching no rule must be allowed")
+	}
+}
+
+func accessEngine(conf Configuration) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(conf.GetAccessHandler())
+	for _, route := range conf.Routes {
+		r.GET(route.Path, route.GetAccessHandler(), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+	}
+	return r
+}
+
+func TestWhitelist(t *testing.T) {
+	r := accessEngine(Configuration{
+		WhiteList: []string{"192.168.1.0/24", "10.0.0.0/8", "127.0.0.1"},
+		Routes:    []Route{{Path: "/"}},
+	})
+	for remoteAddr, expected := range map[string]int{
+		"10.1.2.3:1234":    http.StatusOK,
+		"127.0.0.1:1234":   http.StatusOK,
+		"172.16.0.1:1234":  http.StatusForbidden,
+		"192.168.1.9:1234": http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("%s: expected status %d, got %d", remoteAddr, expected, w.Code)
+		}
+	}
+}
+
+func TestRouteAccess(t *testing.T) {
+	r := accessEngine(Configuration{
+		Access: []AccessRule{{Deny: "203.0.113.0/24"}},
+		Routes: []Route{
+			{Path: "/public"},
+			{Path: "/admin", Access: []AccessRule{{Allow: "10.0.0.0/8"}, {Deny: "all"}}},
+		},
+	})
+	for _, test := range []struct {
+		remoteAddr string
+		path       string
+		expected   int
+	}{
+		{"198.51.100.1:1234", "/public", http.StatusOK},
+		{"203.0.113.5:1234", "/public", http.StatusForbidden},
+		{"198.51.100.1:1234", "/admin", http.StatusForbidden},
+		{"10.0.0.1:1234", "/admin", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		req.RemoteAddr = test.remoteAddr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != test.expected {
+			t.Errorf("%s %s: expected status %d, got %d", test.remoteAddr, test.path, test.expected, w.Code)
+		}
+	}
+}
+
+func TestValidateAccess(t *testing.T) {
+	conf := Configuration{
+		WhiteList: []string{"192.168.1.0/33"},
+		Access:    []AccessRule{{Allow: "10.0.0.0/8", Deny: "all"}},
+		Routes: []Route{{
+			Path:           "/",
+			ForwardUrl:     "http://localhost:8080/",
+			AllowedMethods: []string{"GET"},
+			Access:         []AccessRule{{Deny: "everyone"}},
+		}},
+	}
+	err := conf.Validate()
+	for _, expected := range []string{
+		`whiteList[0]: invalid CIDR range "192.168.1.0/33"`,
+		"access[0]: exactly one of allow and deny must be set",
+		`routes[0].access[0].deny: invalid IP address "everyone"`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q, got %v", expected, err)
+		}
+	}
+}
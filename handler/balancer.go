@@ -0,0 +1,408 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RoundRobin         = "roundRobin"
+	WeightedRoundRobin = "weightedRoundRobin"
+	LeastConnections   = "leastConnections"
+	Random             = "random"
+	PowerOfTwoChoices  = "p2c"
+)
+
+var errNoUpstreamHost = errors.New("no upstream host available")
+
+var loadBalancingStrategies = map[string]func() strategy{
+	"":                 func() strategy { return &roundRobin{} },
+	RoundRobin:         func() strategy { return &roundRobin{} },
+	WeightedRoundRobin: func() strategy { return &weightedRoundRobin{} },
+	LeastConnections:   func() strategy { return &leastConnections{} },
+	Random:             func() strategy { return weightedRandom{} },
+	PowerOfTwoChoices:  func() strategy { return powerOfTwoChoices{} },
+}
+
+func (h *UpstreamHost) UnmarshalJSON(data []byte) error {
+	var hostUrl string
+	if err := json.Unmarshal(data, &hostUrl); err == nil {
+		h.Url = hostUrl
+		return nil
+	}
+	type upstreamHost UpstreamHost
+	return json.Unmarshal(data, (*upstreamHost)(h))
+}
+
+// upstreamHost is the runtime state of one host of an upstream, shared by
+// every route forwarding to it. The weight and the discovered client are
+// guarded by the lock of the balancer.
+type upstreamHost struct {
+	url       string
+	weight    int
+	inflight  int64
+	current   int
+	unhealthy int32
+	breaker   *breaker
+	client    *DiscoveryClient
+}
+
+func (h *upstreamHost) load() int64 {
+	return atomic.LoadInt64(&h.inflight)
+}
+
+// acquire counts a request in flight to the host; the returned function
+// must be called once the request, including its response body, is done.
+func (h *upstreamHost) acquire() func() {
+	atomic.AddInt64(&h.inflight, 1)
+	return func() {
+		atomic.AddInt64(&h.inflight, -1)
+		h.breaker.release()
+	}
+}
+
+func (h *upstreamHost) healthy() bool {
+	return atomic.LoadInt32(&h.unhealthy) == 0
+}
+
+// available reports whether requests may be sent to the host.
+func (h *upstreamHost) available() bool {
+	return h.healthy() && h.breaker.available()
+}
+
+// report feeds the outcome of a request to the circuit breaker of the host.
+func (h *upstreamHost) report(failed bool) {
+	h.breaker.report(failed)
+}
+
+// strategy picks one of the candidate hosts. Candidates are never empty and
+// key is the hash key of the request when the upstream sets hashOn.
+type strategy interface {
+	pick(candidates []*upstreamHost, key string) *upstreamHost
+}
+
+// hostsUpdater is implemented by strategies that keep state about the whole
+// set of hosts and must rebuild it when the set changes.
+type hostsUpdater interface {
+	update(hosts []*upstreamHost)
+}
+
+// loadBalancer selects the hosts of an upstream with its configured strategy.
+// The hosts of a static upstream are fixed; those of a discovered service are
+// replaced by sync as instances register and leave.
+type loadBalancer struct {
+	mu             sync.RWMutex
+	hosts          []*upstreamHost
+	strategy       strategy
+	hashOn         string
+	circuitBreaker *CircuitBreaker
+}
+
+func newLoadBalancer(hosts []*upstreamHost, loadBalancing string, hashOn string) *loadBalancer {
+	lb := &loadBalancer{hashOn: hashOn}
+	if hashOn != "" {
+		lb.strategy = &consistentHash{}
+	} else if newStrategy, ok := loadBalancingStrategies[loadBalancing]; ok {
+		lb.strategy = newStrategy()
+	} else {
+		lb.strategy = loadBalancingStrategies[RoundRobin]()
+	}
+	lb.setHosts(hosts)
+	return lb
+}
+
+func (lb *loadBalancer) setHosts(hosts []*upstreamHost) {
+	lb.hosts = hosts
+	if updater, ok := lb.strategy.(hostsUpdater); ok {
+		updater.update(hosts)
+	}
+}
+
+// sync replaces the hosts of the balancer with the given discovered
+// instances, keeping the state of the hosts that are still registered.
+func (lb *loadBalancer) sync(clients []DiscoveryClient) {
+	lb.mu.RLock()
+	unchanged := len(clients) == len(lb.hosts)
+	for i := 0; unchanged && i < len(clients); i++ {
+		unchanged = lb.hosts[i].client != nil && lb.hosts[i].client.sameInstance(&clients[i]) &&
+			lb.hosts[i].client.sameRegistration(&clients[i])
+	}
+	lb.mu.RUnlock()
+	if unchanged {
+		return
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	// Discovered instances are always ejected passively, with the default
+	// settings unless the upstream of the service sets a circuitBreaker.
+	settings := lb.circuitBreaker
+	if settings == nil {
+		settings = &CircuitBreaker{}
+	}
+	existing := make(map[string]*upstreamHost, len(lb.hosts))
+	for _, host := range lb.hosts {
+		existing[host.url] = host
+	}
+	hosts := make([]*upstreamHost, len(clients))
+	for i := range clients {
+		client := clients[i]
+		url := "http://" + net.JoinHostPort(client.Host, strconv.Itoa(client.Port))
+		host, ok := existing[url]
+		if !ok {
+			host = &upstreamHost{url: url, breaker: newBreaker(settings, url)}
+		}
+		host.weight = client.weight()
+		host.client = &client
+		hosts[i] = host
+	}
+	lb.setHosts(hosts)
+}
+
+// excluding returns exclude together with the discovered hosts whose instance
+// is not kept.
+func (lb *loadBalancer) excluding(exclude map[*upstreamHost]bool, keep func(client *DiscoveryClient) bool) map[*upstreamHost]bool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	excluded := make(map[*upstreamHost]bool, len(exclude)+len(lb.hosts))
+	for host := range exclude {
+		excluded[host] = true
+	}
+	for _, host := range lb.hosts {
+		if host.client != nil && !keep(host.client) {
+			excluded[host] = true
+		}
+	}
+	return excluded
+}
+
+// next returns the host for the hash key among the available hosts that are
+// not in exclude, or nil when there is none. A host whose circuit breaker
+// refuses the request is skipped.
+func (lb *loadBalancer) next(key string, exclude map[*upstreamHost]bool) *upstreamHost {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	candidates := make([]*upstreamHost, 0, len(lb.hosts))
+	for _, host := range lb.hosts {
+		if host.available() && !exclude[host] {
+			candidates = append(candidates, host)
+		}
+	}
+	for len(candidates) > 0 {
+		host := lb.strategy.pick(candidates, key)
+		if host.breaker.allow() {
+			return host
+		}
+		for i, candidate := range candidates {
+			if candidate == host {
+				candidates = append(candidates[:i:i], candidates[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// hashKey returns the value of the request that hashOn refers to: the client
+// IP, a header or a cookie. Requests without that header or cookie are hashed
+// on the client IP.
+func (lb *loadBalancer) hashKey(c *gin.Context) string {
+	if lb.hashOn == "" {
+		return ""
+	}
+	kind := lb.hashOn
+	name := ""
+	if i := strings.Index(lb.hashOn, ":"); i >= 0 {
+		kind, name = lb.hashOn[:i], lb.hashOn[i+1:]
+	}
+	switch kind {
+	case "header":
+		if value := c.GetHeader(name); value != "" {
+			return value
+		}
+	case "cookie":
+		if value, err := c.Cookie(name); err == nil && value != "" {
+			return value
+		}
+	}
+	return c.ClientIP()
+}
+
+// validHashOn reports whether hashOn is ip, header:<name> or cookie:<name>.
+func validHashOn(hashOn string) bool {
+	if hashOn == "ip" {
+		return true
+	}
+	i := strings.Index(hashOn, ":")
+	if i < 0 || i == len(hashOn)-1 {
+		return false
+	}
+	return hashOn[:i] == "header" || hashOn[:i] == "cookie"
+}
+
+// routeBalancer is the load balancer of an upstream as seen by one route:
+// the forwardUrl path of the route is appended to the selected host.
+type routeBalancer struct {
+	*loadBalancer
+	path string
+}
+
+func (rb *routeBalancer) target(host *upstreamHost) string {
+	return host.url + rb.path
+}
+
+// Next returns the URL of the next host, in its Host field, or nil.
+func (rb *routeBalancer) Next() *url.URL {
+	host := rb.next("", nil)
+	if host == nil {
+		return nil
+	}
+	return &url.URL{Host: rb.target(host)}
+}
+
+type roundRobin struct {
+	counter uint64
+}
+
+func (s *roundRobin) pick(candidates []*upstreamHost, key string) *upstreamHost {
+	return candidates[(atomic.AddUint64(&s.counter, 1)-1)%uint64(len(candidates))]
+}
+
+// weightedRoundRobin is the smooth weighted round-robin of nginx: heavier
+// hosts are picked more often without being picked in bursts.
+type weightedRoundRobin struct {
+	mu sync.Mutex
+}
+
+func (s *weightedRoundRobin) pick(candidates []*upstreamHost, key string) *upstreamHost {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0
+	var best *upstreamHost
+	for _, host := range candidates {
+		host.current += host.weight
+		total += host.weight
+		if best == nil || host.current > best.current {
+			best = host
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// lessLoaded reports whether a has fewer requests in flight than b relative
+// to their weights.
+func lessLoaded(a *upstreamHost, b *upstreamHost) bool {
+	return a.load()*int64(b.weight) < b.load()*int64(a.weight)
+}
+
+type leastConnections struct {
+	counter uint64
+}
+
+func (s *leastConnections) pick(candidates []*upstreamHost, key string) *upstreamHost {
+	// Ties are broken in round-robin order so idle hosts share the load.
+	start := int((atomic.AddUint64(&s.counter, 1) - 1) % uint64(len(candidates)))
+	best := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		host := candidates[(start+i)%len(candidates)]
+		if lessLoaded(host, best) {
+			best = host
+		}
+	}
+	return best
+}
+
+type weightedRandom struct{}
+
+func (weightedRandom) pick(candidates []*upstreamHost, key string) *upstreamHost {
+	total := 0
+	for _, host := range candidates {
+		total += host.weight
+	}
+	n := rand.Intn(total)
+	for _, host := range candidates {
+		if n < host.weight {
+			return host
+		}
+		n -= host.weight
+	}
+	return candidates[len(candidates)-1]
+}
+
+// powerOfTwoChoices picks two random hosts and keeps the less loaded one.
+type powerOfTwoChoices struct{}
+
+func (powerOfTwoChoices) pick(candidates []*upstreamHost, key string) *upstreamHost {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	if lessLoaded(candidates[j], candidates[i]) {
+		return candidates[j]
+	}
+	return candidates[i]
+}
+
+// hashReplicas is the number of points of a host of weight 1 on the ring.
+const hashReplicas = 160
+
+// consistentHash maps hash keys to hosts on a hash ring, so that adding or
+// removing a host only moves the keys of its neighbours. Keys whose host is
+// unavailable move to the next available host on the ring.
+type consistentHash struct {
+	mu     sync.RWMutex
+	points []uint32
+	owners map[uint32]*upstreamHost
+}
+
+func (s *consistentHash) update(hosts []*upstreamHost) {
+	points := make([]uint32, 0, len(hosts)*hashReplicas)
+	owners := make(map[uint32]*upstreamHost, len(hosts)*hashReplicas)
+	for _, host := range hosts {
+		for i := 0; i < host.weight*hashReplicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(host.url + "#" + strconv.Itoa(i)))
+			if _, ok := owners[point]; ok {
+				continue
+			}
+			owners[point] = host
+			points = append(points, point)
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+	s.mu.Lock()
+	s.points = points
+	s.owners = owners
+	s.mu.Unlock()
+}
+
+func (s *consistentHash) pick(candidates []*upstreamHost, key string) *upstreamHost {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	allowed := make(map[*upstreamHost]bool, len(candidates))
+	for _, host := range candidates {
+		allowed[host] = true
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(s.points), func(i int) bool { return s.points[i] >= hash })
+	for i := 0; i < len(s.points); i++ {
+		if host := s.owners[s.points[(start+i)%len(s.points)]]; allowed[host] {
+			return host
+		}
+	}
+	return candidates[0]
+}
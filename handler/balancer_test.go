@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func testHosts(weights ...int) []*upstreamHost {
+	hosts := make([]*upstreamHost, len(weights))
+	for i, weight := range weights {
+		hosts[i] = &upstreamHost{url: string(rune('a' + i)), weight: weight}
+	}
+	return hosts
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	lb := newLoadBalancer(testHosts(5, 1, 1), WeightedRoundRobin, "")
+	var picks []string
+	for i := 0; i < 7; i++ {
+		picks = append(picks, lb.next("", nil).url)
+	}
+	if strings.Join(picks, "") != "aabacaa" {
+		t.Errorf("unexpected weighted round-robin order %v", picks)
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	hosts := testHosts(1, 1, 2)
+	lb := newLoadBalancer(hosts, LeastConnections, "")
+	hosts[0].inflight = 1
+	hosts[1].inflight = 3
+	hosts[2].inflight = 3
+	for i := 0; i < 3; i++ {
+		if host := lb.next("", nil); host != hosts[0] {
+			t.Errorf("least loaded host must be picked, got %s", host.url)
+		}
+	}
+	hosts[0].inflight = 2
+	if host := lb.next("", nil); host != hosts[2] {
+		t.Errorf("weights must be taken into account, got %s", host.url)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	hosts := testHosts(1, 0, 3)
+	lb := newLoadBalancer(hosts, Random, "")
+	counts := make(map[*upstreamHost]int)
+	for i := 0; i < 4000; i++ {
+		counts[lb.next("", nil)]++
+	}
+	if counts[hosts[1]] != 0 {
+		t.Error("a host with no weight must not be picked")
+	}
+	if counts[hosts[2]] < 2*counts[hosts[0]] {
+		t.Errorf("heavier host must be picked more often: %v", counts)
+	}
+}
+
+func TestPowerOfTwoChoices(t *testing.T) {
+	hosts := testHosts(1, 1)
+	lb := newLoadBalancer(hosts, PowerOfTwoChoices, "")
+	hosts[0].inflight = 10
+	for i := 0; i < 10; i++ {
+		if host := lb.next("", nil); host != hosts[1] {
+			t.Errorf("less loaded host must be picked, got %s", host.url)
+		}
+	}
+}
+
+func TestLoadBalancerExclude(t *testing.T) {
+	hosts := testHosts(1, 1)
+	lb := newLoadBalancer(hosts, RoundRobin, "")
+	exclude := map[*upstreamHost]bool{hosts[0]: true}
+	for i := 0; i < 3; i++ {
+		if host := lb.next("", exclude); host != hosts[1] {
+			t.Errorf("excluded host must not be picked, got %s", host.url)
+		}
+	}
+	exclude[hosts[1]] = true
+	if lb.next("", exclude) != nil {
+		t.Error("no host must be picked when all are excluded")
+	}
+}
+
+func TestValidateLoadBalancing(t *testing.T) {
+	conf := Configuration{
+		Upstreams: map[string]*Upstream{
+			"test": {Hosts: []UpstreamHost{{Url: "http://localhost:8080", Weight: -1}}, LoadBalancing: "fastest"},
+		},
+		Routes: []Route{{Path: "/", ForwardUrl: "test:/", AllowedMethods: []string{"GET"}}},
+	}
+	err := conf.Validate()
+	if err == nil || !strings.Contains(err.Error(), `unknown load balancing strategy "fastest"`) || !strings.Contains(err.Error(), "weight must not be negative") {
+		t.Errorf("invalid load balancing settings must be rejected, got %v", err)
+	}
+	conf.Upstreams["test"] = &Upstream{Hosts: []UpstreamHost{{Url: "http://localhost:8080"}}, HashOn: "query:id"}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.Error(), "hashOn must be ip, header:<name> or cookie:<name>") {
+		t.Errorf("invalid hashOn must be rejected, got %v", err)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	hosts := testHosts(1, 1, 1, 1)
+	lb := newLoadBalancer(hosts, "", "header:X-User")
+	owners := make(map[string]*upstreamHost)
+	for i := 0; i < 1000; i++ {
+		key := "user" + strconv.Itoa(i)
+		owners[key] = lb.next(key, nil)
+		if lb.next(key, nil) != owners[key] {
+			t.Fatal("a key must always be mapped to the same host")
+		}
+	}
+	lb.setHosts(hosts[:3])
+	moved := 0
+	for key, owner := range owners {
+		host := lb.next(key, nil)
+		if owner != hosts[3] && host != owner {
+			moved++
+		}
+	}
+	if moved > 0 {
+		t.Errorf("removing a host must only move its own keys, %d others moved", moved)
+	}
+	exclude := map[*upstreamHost]bool{owners["user1"]: true}
+	if host := lb.next("user1", exclude); host == nil || host == owners["user1"] {
+		t.Error("the key of an unavailable host must move to another host")
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "10.0.0.1:1234"
+	request.Header.Set("X-User", "alice")
+	request.AddCookie(&http.Cookie{Name: "SESSION", Value: "abc"})
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = request
+	tests := map[string]string{
+		"ip":             "10.0.0.1",
+		"header:X-User":  "alice",
+		"cookie:SESSION": "abc",
+		"header:X-Other": "10.0.0.1",
+	}
+	for hashOn, expected := range tests {
+		lb := newLoadBalancer(nil, "", hashOn)
+		if key := lb.hashKey(c); key != expected {
+			t.Errorf("hashOn %s must hash on %s, got %s", hashOn, expected, key)
+		}
+	}
+}
+
+func TestDiscoveryBalancerSync(t *testing.T) {
+	lb := newLoadBalancer(nil, "", "ip")
+	clients := []DiscoveryClient{
+		{Service: "echo", Host: "10.0.0.1", Port: 8080, Active: true},
+		{Service: "echo", Host: "10.0.0.2", Port: 8080, Active: true},
+	}
+	lb.sync(clients)
+	host := lb.next("192.168.1.1", nil)
+	if host == nil || host.client == nil {
+		t.Fatal("discovered instances must be balanced")
+	}
+	lb.sync(append(clients, DiscoveryClient{Service: "echo", Host: "10.0.0.3", Port: 8080, Active: true}))
+	if len(lb.hosts) != 3 || (lb.hosts[0] != host && lb.hosts[1] != host) {
+		t.Error("the state of instances still registered must be kept")
+	}
+}
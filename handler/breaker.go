@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (cb *CircuitBreaker) validate(conf *Configuration, path string) Errors {
+	errs := conf.nonNegative(path,
+		setting{"consecutiveFailures", cb.ConsecutiveFailures},
+		setting{"minRequests", cb.MinRequests},
+		setting{"window", cb.Window},
+		setting{"ejectionTime", cb.EjectionTime},
+		setting{"maxEjectionTime", cb.MaxEjectionTime},
+	)
+	if cb.ErrorRate < 0 || cb.ErrorRate > 100 {
+		errs = append(errs, conf.fieldError(path+".errorRate", "errorRate must be a percentage between 0 and 100"))
+	}
+	return errs
+}
+
+// breaker is the circuit breaker of one upstream host.
+type breaker struct {
+	settings *CircuitBreaker
+	host     string
+
+	mu          sync.Mutex
+	state       int
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	openUntil   time.Time
+	ejections   int
+}
+
+func newBreaker(settings *CircuitBreaker, host string) *breaker {
+	if settings == nil {
+		return nil
+	}
+	return &breaker{settings: settings, host: host}
+}
+
+// available reports whether the host may get a request: the breaker is
+// closed, or its ejection is over and no probe is in flight.
+func (b *breaker) available() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerClosed || (b.state == breakerOpen && !time.Now().Before(b.openUntil))
+}
+
+// allow is called once the host was picked for a request. An ejected host
+// whose ejection is over lets exactly one probe request through.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	}
+	return false
+}
+
+// report records the outcome of a request sent to the host.
+func (b *breaker) report(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		if failed {
+			b.open()
+		} else {
+			b.state = breakerClosed
+			b.ejections = 0
+			b.reset()
+			log.Printf("circuit breaker of host %s closed", b.host)
+		}
+		return
+	}
+	if b.state != breakerClosed {
+		return
+	}
+	now := time.Now()
+	if now.Sub(b.windowStart) > milliseconds(b.settings.Window, 10*time.Second) {
+		b.windowStart = now
+		b.requests, b.failures = 0, 0
+	}
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+	if b.consecutive >= threshold(b.settings.ConsecutiveFailures, 5) {
+		b.open()
+		return
+	}
+	if b.settings.ErrorRate > 0 && b.requests >= threshold(b.settings.MinRequests, 10) && b.failures*100 >= b.settings.ErrorRate*b.requests {
+		b.open()
+	}
+}
+
+// release gives up the probe of a half-open breaker whose request ended
+// without an outcome, so that the next request probes the host instead.
+func (b *breaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
+
+// open ejects the host, doubling the ejection time on every ejection in a
+// row. It must be called with the lock held.
+func (b *breaker) open() {
+	ejection := milliseconds(b.settings.EjectionTime, 30*time.Second)
+	maxEjection := milliseconds(b.settings.MaxEjectionTime, 300*time.Second)
+	for i := 0; i < b.ejections && ejection < maxEjection; i++ {
+		ejection *= 2
+	}
+	if ejection > maxEjection {
+		ejection = maxEjection
+	}
+	b.ejections++
+	b.state = breakerOpen
+	b.openUntil = time.Now().Add(ejection)
+	b.reset()
+	log.Printf("circuit breaker of host %s opened for %s", b.host, ejection)
+}
+
+func (b *breaker) reset() {
+	b.consecutive = 0
+	b.windowStart = time.Now()
+	b.requests, b.failures = 0, 0
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	b := newBreaker(&CircuitBreaker{ConsecutiveFailures: 3, EjectionTime: 20, MaxEjectionTime: 30}, "a")
+	for i := 0; i < 2; i++ {
+		b.report(true)
+	}
+	b.report(false)
+	b.report(true)
+	if !b.available() {
+		t.Fatal("a success must reset the consecutive failures")
+	}
+	b.report(true)
+	b.report(true)
+	if b.available() || b.allow() {
+		t.Fatal("the breaker must open after consecutive failures")
+	}
+	time.Sleep(25 * time.Millisecond)
+	if !b.available() || !b.allow() {
+		t.Fatal("the breaker must let a probe through after the ejection time")
+	}
+	if b.allow() {
+		t.Fatal("only one probe must be let through")
+	}
+	b.report(true)
+	if b.openUntil.Sub(time.Now()) <= 20*time.Millisecond {
+		t.Error("the ejection time must grow on every ejection in a row")
+	}
+	time.Sleep(35 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("the ejection time must not exceed maxEjectionTime")
+	}
+	b.report(false)
+	if b.state != breakerClosed || b.ejections != 0 {
+		t.Error("a successful probe must close the breaker")
+	}
+}
+
+func TestBreakerErrorRate(t *testing.T) {
+	b := newBreaker(&CircuitBreaker{ConsecutiveFailures: 100, ErrorRate: 50, MinRequests: 4}, "a")
+	b.report(true)
+	b.report(false)
+	b.report(true)
+	if !b.available() {
+		t.Fatal("the error rate must not apply below minRequests")
+	}
+	b.report(true)
+	if b.available() {
+		t.Error("the breaker must open once the error rate is reached")
+	}
+}
+
+func TestBreakerReleaseProbe(t *testing.T) {
+	host := &upstreamHost{url: "a", weight: 1, breaker: newBreaker(&CircuitBreaker{ConsecutiveFailures: 1, EjectionTime: 1}, "a")}
+	host.report(true)
+	time.Sleep(2 * time.Millisecond)
+	if !host.breaker.allow() {
+		t.Fatal("the breaker must let a probe through")
+	}
+	host.acquire()()
+	if !host.breaker.allow() {
+		t.Error("a probe without outcome must be released")
+	}
+}
+
+func TestCircuitBreakerFailFast(t *testing.T) {
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+	conf := &Configuration{
+		Upstreams: map[string]*Upstream{
+			"test": {
+				Hosts:          []UpstreamHost{{Url: upstream.URL}},
+				CircuitBreaker: &CircuitBreaker{ConsecutiveFailures: 2},
+			},
+		},
+	}
+	defer conf.Close()
+	route := Route{Path: "/", ForwardUrl: "test:/", AllowedMethods: []string{"GET"}}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", route.GetCoreHandler(conf, "GET", nil))
+	for i, expected := range []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != expected {
+			t.Errorf("request %d: expected status %d, got %d", i, expected, w.Code)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("no request must reach an ejected host, got %d", requests)
+	}
+}
+
+func TestValidateCircuitBreaker(t *testing.T) {
+	conf := Configuration{
+		Upstreams: map[string]*Upstream{
+			"test": {
+				Hosts:          []UpstreamHost{{Url: "http://localhost:8080"}},
+				CircuitBreaker: &CircuitBreaker{ErrorRate: 150, EjectionTime: -1},
+			},
+		},
+		Routes: []Route{{Path: "/", ForwardUrl: "test:/", AllowedMethods: []string{"GET"}}},
+	}
+	err := conf.Validate()
+	for _, expected := range []string{"errorRate must be a percentage between 0 and 100", "ejectionTime must not be negative"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q, got %v", expected, err)
+		}
+	}
+}
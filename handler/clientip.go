@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// peerAddrKey is the context key under which the client IP handler keeps the
+// address of the peer that actually connected to goginx.
+const peerAddrKey = "goginx.peerAddr"
+
+var clientIpHeaders = []string{"X-Forwarded-For", "X-Real-IP", "CF-Connecting-IP"}
+
+// parseCIDRs parses a list of IP addresses and CIDR ranges.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, entry := range list {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIpHeader returns the canonical name of the header the client IP is
+// read from when the peer is a trusted proxy.
+func (conf *Configuration) clientIpHeader() string {
+	if conf.ClientIpHeader == "" {
+		return clientIpHeaders[0]
+	}
+	for _, header := range clientIpHeaders {
+		if strings.EqualFold(header, conf.ClientIpHeader) {
+			return header
+		}
+	}
+	return conf.ClientIpHeader
+}
+
+// resolveClientIP returns the IP of the client of a request received from
+// peer. Only trusted proxies are believed: X-Forwarded-For is walked from the
+// right, skipping trusted proxies, and the single address headers are used as
+// is when the peer is trusted.
+func resolveClientIP(peer net.IP, header http.Header, name string, trusted []*net.IPNet) net.IP {
+	if !containsIP(trusted, peer) {
+		return peer
+	}
+	if name != "X-Forwarded-For" {
+		if ip := net.ParseIP(strings.TrimSpace(header.Get(name))); ip != nil {
+			return ip
+		}
+		return peer
+	}
+	var chain []string
+	for _, value := range header.Values(name) {
+		chain = append(chain, strings.Split(value, ",")...)
+	}
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(chain[i]))
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !containsIP(trusted, ip) {
+			break
+		}
+	}
+	return client
+}
+
+// GetClientIPHandler resolves the IP of the client from the trusted proxies
+// and replaces the remote address of the request with it, so that logging,
+// whitelisting and every later use of c.ClientIP() agree on the client.
+func (conf *Configuration) GetClientIPHandler() gin.HandlerFunc {
+	trusted, _ := parseCIDRs(conf.TrustedProxies)
+	name := conf.clientIpHeader()
+	return func(c *gin.Context) {
+		c.Set(peerAddrKey, c.Request.RemoteAddr)
+		host, port, err := net.SplitHostPort(c.Request.RemoteAddr)
+		if err != nil {
+			return
+		}
+		peer := net.ParseIP(host)
+		if peer == nil {
+			return
+		}
+		if client := resolveClientIP(peer, c.Request.Header, name, trusted); !client.Equal(peer) {
+			c.Request.RemoteAddr = net.JoinHostPort(client.String(), port)
+		}
+	}
+}
+
+// peerAddr returns the address of the peer that connected to goginx, which
+// may be a proxy rather than the client.
+func peerAddr(c *gin.Context) string {
+	if addr := c.GetString(peerAddrKey); addr != "" {
+		return addr
+	}
+	return c.Request.RemoteAddr
+}
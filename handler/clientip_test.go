@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		peer     string
+		name     string
+		value    string
+		expected string
+	}{
+		{"203.0.113.9", "X-Forwarded-For", "1.1.1.1", "203.0.113.9"},
+		{"10.0.0.1", "X-Forwarded-For", "1.1.1.1, 198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		{"192.0.2.1", "X-Forwarded-For", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"2001:db8::1", "X-Forwarded-For", "2001:db9::1", "2001:db9::1"},
+		{"10.0.0.1", "X-Forwarded-For", "", "10.0.0.1"},
+		{"10.0.0.1", "X-Forwarded-For", "garbage, 198.51.100.7", "198.51.100.7"},
+		{"10.0.0.1", "CF-Connecting-IP", "198.51.100.8", "198.51.100.8"},
+		{"203.0.113.9", "X-Real-IP", "198.51.100.8", "203.0.113.9"},
+	}
+	for _, test := range tests {
+		header := make(http.Header)
+		if test.value != "" {
+			header.Set(test.name, test.value)
+		}
+		if ip := resolveClientIP(net.ParseIP(test.peer), header, test.name, trusted); ip.String() != test.expected {
+			t.Errorf("peer %s with %s %q: expected %s, got %s", test.peer, test.name, test.value, test.expected, ip)
+		}
+	}
+}
+
+func TestClientIPHandler(t *testing.T) {
+	conf := &Configuration{TrustedProxies: []string{"10.0.0.0/8"}, ClientIpHeader: "x-real-ip"}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.ForwardedByClientIP = false
+	r.Use(conf.GetClientIPHandler())
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, c.ClientIP()+" "+peerAddr(c))
+	})
+	for remoteAddr, expected := range map[string]string{
+		"10.0.0.1:1234":    "198.51.100.8 10.0.0.1:1234",
+		"203.0.113.9:1234": "203.0.113.9 203.0.113.9:1234",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Real-IP", "198.51.100.8")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Body.String() != expected {
+			t.Errorf("expected %q, got %q", expected, w.Body.String())
+		}
+	}
+}
+
+func TestValidateTrustedProxies(t *testing.T) {
+	conf := Configuration{
+		TrustedProxies: []string{"10.0.0.0/8", "10.0.0.300"},
+		ClientIpHeader: "X-Client",
+		Routes:         []Route{{Path: "/", ForwardUrl: "http://localhost:8080/", AllowedMethods: []string{"GET"}}},
+	}
+	err := conf.Validate()
+	for _, expected := range []string{`trustedProxies[1]: invalid IP address "10.0.0.300"`, "clientIpHeader must be X-Forwarded-For, X-Real-IP or CF-Connecting-IP"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := append([]byte{}, proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12)
+	v2 = append(v2, 198, 51, 100, 7, 10, 0, 0, 1, 0, 0, 0, 80)
+	binary.BigEndian.PutUint16(v2[len(v2)-4:], 40000)
+	tests := map[string]string{
+		"PROXY TCP4 198.51.100.7 10.0.0.1 40000 80\r\nGET":    "198.51.100.7:40000",
+		"PROXY TCP6 2001:db8::7 2001:db8::1 40000 443\r\nGET": "[2001:db8::7]:40000",
+		"PROXY UNKNOWN\r\nGET":                                "",
+		string(v2) + "GET":                                    "198.51.100.7:40000",
+		"GET / HTTP/1.1\r\n":                                  "error",
+		"PROXY TCP4 198.51.100.300 10.0.0.1 40000 80\r\nGET":  "error",
+	}
+	for header, expected := range tests {
+		r := bufio.NewReader(strings.NewReader(header))
+		addr, err := readProxyHeader(r)
+		switch {
+		case expected == "error":
+			if err == nil {
+				t.Errorf("%q must be rejected", header)
+			}
+		case err != nil:
+			t.Errorf("%q: %v", header, err)
+		case expected == "" && addr != nil, expected != "" && (addr == nil || addr.String() != expected):
+			t.Errorf("%q: expected %q, got %v", header, expected, addr)
+		default:
+			if rest, _ := ioutil.ReadAll(r); string(rest) != "GET" {
+				t.Errorf("%q: the data after the header must be kept, got %q", header, rest)
+			}
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &Configuration{}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.RemoteAddr))
+	})}
+	go server.Serve(conf.NewProxyProtocolListener(ln))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("PROXY TCP4 198.51.100.7 10.0.0.1 40000 80\r\nGET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "198.51.100.7:40000" {
+		t.Errorf("the address of the PROXY header must be the remote address, got %q", body)
+	}
+}
@@ -0,0 +1,392 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLeaseTtl = 30 * time.Second
+	evictInterval   = time.Second
+)
+
+var errInstanceNotFound = errors.New("service instance not found")
+
+// NewDiscoveryService returns an empty registry that evicts the instances
+// whose lease expired until it is stopped.
+func NewDiscoveryService() *DiscoveryService {
+	s := &DiscoveryService{
+		services: make(map[string][]*DiscoveryClient),
+		changed:  make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+	go s.evictExpiredLeases()
+	return s
+}
+
+func (client *DiscoveryClient) leaseTtl() time.Duration {
+	if client.Ttl > 0 {
+		return time.Duration(client.Ttl) * time.Second
+	}
+	return defaultLeaseTtl
+}
+
+func (client *DiscoveryClient) sameInstance(other *DiscoveryClient) bool {
+	return client.Service == other.Service && client.Host == other.Host && client.Port == other.Port
+}
+
+// sameRegistration reports whether a renewal leaves the lease and the
+// attributes of the instance unchanged.
+func (client *DiscoveryClient) sameRegistration(other *DiscoveryClient) bool {
+	if client.Ttl != other.Ttl || client.Weight != other.Weight || client.Version != other.Version || client.Zone != other.Zone ||
+		client.HealthCheckPath != other.HealthCheckPath {
+		return false
+	}
+	if len(client.Tags) != len(other.Tags) || len(client.Metadata) != len(other.Metadata) {
+		return false
+	}
+	for i := range client.Tags {
+		if client.Tags[i] != other.Tags[i] {
+			return false
+		}
+	}
+	for key, value := range client.Metadata {
+		if other, ok := other.Metadata[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (client *DiscoveryClient) weight() int {
+	if client.Weight > 0 {
+		return client.Weight
+	}
+	return 1
+}
+
+func (client *DiscoveryClient) hasTag(tag string) bool {
+	for _, t := range client.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the instance has the version, the tags and the
+// metadata required by the filter.
+func (filter *DiscoveryFilter) matches(client *DiscoveryClient) bool {
+	if filter.Version != "" && client.Version != filter.Version {
+		return false
+	}
+	for _, tag := range filter.Tags {
+		if !client.hasTag(tag) {
+			return false
+		}
+	}
+	for key, value := range filter.Metadata {
+		if other, ok := client.Metadata[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// GetActiveServices returns copies of the active instances registered for a
+// service.
+func (s *DiscoveryService) GetActiveServices(serviceName string) ([]DiscoveryClient, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	instances, ok := s.services[serviceName]
+	if !ok {
+		return nil, errors.New("service not found")
+	}
+	active := make([]DiscoveryClient, 0, len(instances))
+	for _, instance := range instances {
+		if instance.Active {
+			active = append(active, *instance)
+		}
+	}
+	if len(active) == 0 {
+		return nil, errors.New("no active service found")
+	}
+	return active, nil
+}
+
+// AppendService registers an instance, or renews the lease and updates the
+// attributes of an instance that is already registered.
+func (s *DiscoveryService) AppendService(service *DiscoveryClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	registered := *service
+	registered.Active = true
+	registered.LastHeartbeat = time.Now()
+	for i, instance := range s.services[service.Service] {
+		if instance.sameInstance(service) {
+			// Only the health checks reactivate an instance found unhealthy.
+			registered.Active = instance.Active
+			if !instance.sameRegistration(&registered) {
+				defer s.notify()
+			}
+			s.services[service.Service][i] = &registered
+			return
+		}
+	}
+	s.services[service.Service] = append(s.services[service.Service], &registered)
+	s.notify()
+}
+
+// RemoveService deregisters an instance.
+func (s *DiscoveryService) RemoveService(service *DiscoveryClient) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	instances := s.services[service.Service]
+	for i, instance := range instances {
+		if instance.sameInstance(service) {
+			s.remove(service.Service, i)
+			s.notify()
+			return nil
+		}
+	}
+	return errInstanceNotFound
+}
+
+// remove deletes the i-th instance of a service. It must be called with the
+// lock held.
+func (s *DiscoveryService) remove(serviceName string, i int) {
+	instances := s.services[serviceName]
+	instances = append(instances[:i:i], instances[i+1:]...)
+	if len(instances) == 0 {
+		delete(s.services, serviceName)
+		return
+	}
+	s.services[serviceName] = instances
+}
+
+// evict removes the instances whose lease expired before now.
+func (s *DiscoveryService) evict(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for serviceName, instances := range s.services {
+		for i := len(instances) - 1; i >= 0; i-- {
+			instance := instances[i]
+			if now.Sub(instance.LastHeartbeat) > instance.leaseTtl() {
+				log.Printf("discovery: lease of %s at %s expired", serviceName, net.JoinHostPort(instance.Host, strconv.Itoa(instance.Port)))
+				s.remove(serviceName, i)
+				s.notify()
+			}
+		}
+	}
+}
+
+func (s *DiscoveryService) evictExpiredLeases() {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.evict(now)
+		}
+	}
+}
+
+// notify records a change of the registry and wakes up its watchers. It must
+// be called with the lock held.
+func (s *DiscoveryService) notify() {
+	s.revision++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Instances returns the revision of the registry and copies of the instances
+// of a service, or of every service when serviceName is empty, along with a
+// channel that is closed on the next change.
+func (s *DiscoveryService) Instances(serviceName string) (uint64, map[string][]DiscoveryClient, <-chan struct{}) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	services := make(map[string][]DiscoveryClient)
+	for name, instances := range s.services {
+		if serviceName != "" && name != serviceName {
+			continue
+		}
+		for _, instance := range instances {
+			services[name] = append(services[name], *instance)
+		}
+	}
+	return s.revision, services, s.changed
+}
+
+// snapshot returns copies of every registered instance.
+func (s *DiscoveryService) snapshot() map[string][]DiscoveryClient {
+	_, services, _ := s.Instances("")
+	return services
+}
+
+// SetHealthCheck sets the interval, timeout, thresholds, expected status and
+// default path of the health checks of the registered instances.
+func (s *DiscoveryService) SetHealthCheck(check *HealthCheck) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthCheck = check
+}
+
+// instanceHealth counts the consecutive successful and failed health checks
+// of an instance.
+type instanceHealth struct {
+	successes int
+	failures  int
+}
+
+// HeartBeatServices health checks every registered instance until the
+// registry is stopped. An instance is deactivated after unhealthyThreshold
+// failed checks in a row and reactivated after healthyThreshold successful
+// ones.
+func (s *DiscoveryService) HeartBeatServices() {
+	health := make(map[string]*instanceHealth)
+	for {
+		s.mu.RLock()
+		check := s.healthCheck
+		s.mu.RUnlock()
+		if check == nil {
+			check = &HealthCheck{}
+		}
+		s.checkInstances(check, health)
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(milliseconds(check.Interval, 10*time.Second)):
+		}
+	}
+}
+
+// checkInstances checks every instance once, concurrently, and applies the
+// results to the registry.
+func (s *DiscoveryService) checkInstances(check *HealthCheck, health map[string]*instanceHealth) {
+	low, high, _ := parseStatusRange(check.ExpectedStatus)
+	healthyThreshold := threshold(check.HealthyThreshold, 2)
+	unhealthyThreshold := threshold(check.UnhealthyThreshold, 3)
+	client := &http.Client{Timeout: milliseconds(check.Timeout, 2*time.Second)}
+	var instances []DiscoveryClient
+	for _, serviceClients := range s.snapshot() {
+		instances = append(instances, serviceClients...)
+	}
+	results := make([]error, len(instances))
+	var wg sync.WaitGroup
+	for i := range instances {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = s.probe(&instances[i], check.Path, client, low, high)
+		}(i)
+	}
+	wg.Wait()
+	checked := make(map[string]*instanceHealth, len(instances))
+	for i := range instances {
+		instance := &instances[i]
+		key := instance.Service + "/" + instance.address()
+		counts, ok := health[key]
+		if !ok {
+			counts = &instanceHealth{}
+		}
+		checked[key] = counts
+		if err := results[i]; err == nil {
+			counts.failures = 0
+			counts.successes++
+			if counts.successes >= healthyThreshold && s.setActive(instance, true) {
+				log.Printf("discovery: instance %s of service %s is healthy", instance.address(), instance.Service)
+			}
+		} else {
+			counts.successes = 0
+			counts.failures++
+			if counts.failures >= unhealthyThreshold && s.setActive(instance, false) {
+				log.Printf("discovery: instance %s of service %s is unhealthy: %v", instance.address(), instance.Service, err)
+			}
+		}
+	}
+	for key := range health {
+		delete(health, key)
+	}
+	for key, counts := range checked {
+		health[key] = counts
+	}
+}
+
+func (client *DiscoveryClient) address() string {
+	return net.JoinHostPort(client.Host, strconv.Itoa(client.Port))
+}
+
+// probe sends a GET request on the health check path of the instance, or
+// the default path, and expects a status between low and high. Instances
+// without any path are only connected to.
+func (s *DiscoveryService) probe(instance *DiscoveryClient, defaultPath string, client *http.Client, low int, high int) error {
+	path := instance.HealthCheckPath
+	if path == "" {
+		path = defaultPath
+	}
+	if path == "" {
+		conn, err := net.DialTimeout("tcp", instance.address(), client.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+instance.address()+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < low || resp.StatusCode > high {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// setActive sets the active state of an instance and reports whether it
+// changed.
+func (s *DiscoveryService) setActive(client *DiscoveryClient, active bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, instance := range s.services[client.Service] {
+		if instance.sameInstance(client) {
+			if instance.Active == active {
+				return false
+			}
+			instance.Active = active
+			s.notify()
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DiscoveryService) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
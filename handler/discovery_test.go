@@ -0,0 +1,448 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDiscoveryServiceConcurrency(t *testing.T) {
+	s := NewDiscoveryService()
+	defer s.Stop()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				client := &DiscoveryClient{Service: "echo", Host: "10.0.0." + strconv.Itoa(i), Port: 8080 + j%4}
+				s.AppendService(client)
+				if clients, err := s.GetActiveServices("echo"); err == nil {
+					s.setActive(&clients[0], false)
+				}
+				s.evict(time.Now())
+				if j%3 == 0 {
+					_ = s.RemoveService(client)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, instances := range s.snapshot() {
+		if len(instances) > 8*4 {
+			t.Errorf("instances must be registered once, got %d", len(instances))
+		}
+	}
+}
+
+func TestDiscoveryLease(t *testing.T) {
+	s := NewDiscoveryService()
+	defer s.Stop()
+	s.AppendService(&DiscoveryClient{Service: "echo", Host: "10.0.0.1", Port: 8080, Ttl: 10})
+	s.AppendService(&DiscoveryClient{Service: "echo", Host: "10.0.0.2", Port: 8080})
+	s.evict(time.Now().Add(15 * time.Second))
+	clients, err := s.GetActiveServices("echo")
+	if err != nil || len(clients) != 1 || clients[0].Host != "10.0.0.2" {
+		t.Fatalf("only the expired lease must be evicted, got %v %v", clients, err)
+	}
+	s.services["echo"][0].LastHeartbeat = time.Now().Add(-20 * time.Second)
+	s.AppendService(&DiscoveryClient{Service: "echo", Host: "10.0.0.2", Port: 8080})
+	s.evict(time.Now().Add(15 * time.Second))
+	if _, err := s.GetActiveServices("echo"); err != nil {
+		t.Error("registering again must renew the lease")
+	}
+	s.evict(time.Now().Add(time.Minute))
+	if _, err := s.GetActiveServices("echo"); err == nil || err.Error() != "service not found" {
+		t.Errorf("services without instances must be removed, got %v", err)
+	}
+}
+
+func TestDiscoveryEndpoint(t *testing.T) {
+	s := NewDiscoveryService()
+	defer s.Stop()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/discovery", s.GetRegistrationHandler())
+	r.DELETE("/discovery", s.GetDeregistrationHandler())
+	send := func(method string, body string) int {
+		req := httptest.NewRequest(method, "/discovery", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	instance := `{ "service": "echo", "host": "10.0.0.1", "port": 8080, "ttl": 60 }`
+	if code := send(http.MethodPost, instance); code != http.StatusOK {
+		t.Errorf("registration failed with %d", code)
+	}
+	if code := send(http.MethodPost, `{ "service": "echo", "host": "10.0.0.1", "port": 8080, "ttl": -1 }`); code != http.StatusBadRequest {
+		t.Errorf("a negative ttl must be rejected, got %d", code)
+	}
+	if code := send(http.MethodDelete, instance); code != http.StatusOK {
+		t.Errorf("deregistration failed with %d", code)
+	}
+	if code := send(http.MethodDelete, instance); code != http.StatusNotFound {
+		t.Errorf("deregistration of an unknown instance must fail with 404, got %d", code)
+	}
+	if _, err := s.GetActiveServices("echo"); err == nil {
+		t.Error("the deregistered instance must be removed")
+	}
+}
+
+func TestDiscoveryQuery(t *testing.T) {
+	s := NewDiscoveryService()
+	defer s.Stop()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/discovery", s.GetQueryHandler())
+	r.GET("/discovery/:service", s.GetQueryHandler())
+	s.AppendService(&DiscoveryClient{Service: "echo", Host: "10.0.0.1", Port: 8080})
+	s.AppendService(&DiscoveryClient{Service: "time", Host: "10.0.0.2", Port: 8080})
+	s.setActive(&DiscoveryClient{Service: "time", Host: "10.0.0.2", Port: 8080}, false)
+	query := func(target string) (int, map[string]json.RawMessage, string) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		body := map[string]json.RawMessage{}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body, w.Header().Get("X-Discovery-Index")
+	}
+	code, body, index := query("/discovery")
+	if code != http.StatusOK || index != "3" {
+		t.Fatalf("expected index 3, got %d %q", code, index)
+	}
+	services := map[string][]DiscoveryClient{}
+	if err := json.Unmarshal(body["services"], &services); err != nil || len(services) != 2 {
+		t.Fatalf("every service must be listed, got %s", body["services"])
+	}
+	if services["time"][0].Active || services["time"][0].LastHeartbeat.IsZero() {
+		t.Errorf("inactive instances must be listed with their last heartbeat, got %+v", services["time"][0])
+	}
+	_, body, _ = query("/discovery/echo")
+	var instances []DiscoveryClient
+	if err := json.Unmarshal(body["instances"], &instances); err != nil || len(instances) != 1 || !instances[0].Active {
+		t.Errorf("expected the echo instance, got %s", body["instances"])
+	}
+	if _, body, _ = query("/discovery/unknown"); string(body["instances"]) != "[]" {
+		t.Errorf("unknown services must have no instances, got %s", body["instances"])
+	}
+	if code, _, _ = query("/discovery?index=x"); code != http.StatusBadRequest {
+		t.Errorf("an invalid index must be rejected, got %d", code)
+	}
+
+	start := time.Now()
+	if _, _, index = query("/discovery/echo?index=3&wait=50"); index != "3" || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("an unchanged registry must be waited for, got %q after %s", index, time.Since(start))
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.AppendService(&DiscoveryClient{Service: "echo", Host: "10.0.0.3", Port: 8080})
+	}()
+	if _, body, index = query("/discovery/echo?index=3&wait=5000"); index != "4" || !strings.Contains(string(body["instances"]), "10.0.0.3") {
+		t.Errorf("a change must end the wait, got %q %s", index, body["instances"])
+	}
+	s.AppendService(&DiscoveryClient{Service: "echo", Host: "10.0.0.3", Port: 8080})
+	if _, _, index = query("/discovery"); index != "4" {
+		t.Errorf("renewing a lease must not change the index, got %q", index)
+	}
+}
+
+func TestDiscoveryWatch(t *testing.T) {
+	s := NewDiscoveryService()
+	defer s.Stop()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/discovery/:service", s.GetQueryHandler())
+	server := httptest.NewServer(r)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/discovery/echo?watch=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", resp.Header.Get("Content-Type"))
+	}
+	events := bufio.NewReader(resp.Body)
+	next := func() string {
+		var event string
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				return event
+			}
+			event += line
+		}
+	}
+	if event := next(); !strings.HasPrefix(event, "id: 0\nevent: services\n") || !strings.Contains(event, `"instances":[]`) {
+		t.Errorf("the current state must be sent first, got %q", event)
+	}
+	s.AppendService(&DiscoveryClient{Service: "echo", Host: "10.0.0.1", Port: 8080})
+	if event := next(); !strings.HasPrefix(event, "id: 1\n") || !strings.Contains(event, `"host":"10.0.0.1"`) {
+		t.Errorf("registrations must be streamed, got %q", event)
+	}
+}
+
+func TestDiscoveryFilter(t *testing.T) {
+	s := NewDiscoveryService()
+	defer s.Stop()
+	var servers []*httptest.Server
+	register := func(name string, client DiscoveryClient) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		}))
+		servers = append(servers, server)
+		host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+		client.Service, client.Host = "echo", host
+		client.Port, _ = strconv.Atoi(port)
+		s.AppendService(&client)
+	}
+	defer func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}()
+	register("blue", DiscoveryClient{Version: "v1", Zone: "a"})
+	register("green-a", DiscoveryClient{Version: "v2", Zone: "a", Tags: []string{"canary"}})
+	register("green-b", DiscoveryClient{Version: "v2", Zone: "b", Metadata: map[string]string{"team": "core"}})
+
+	conf := &Configuration{Discovery: true}
+	get := func(filter *DiscoveryFilter) map[string]int {
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		route := Route{Path: "/", ForwardUrl: "echo:/", AllowedMethods: []string{http.MethodGet}, Discovery: filter}
+		r.GET("/", route.GetCoreHandler(conf, http.MethodGet, s))
+		counts := make(map[string]int)
+		for i := 0; i < 6; i++ {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			counts[w.Body.String()]++
+		}
+		return counts
+	}
+	if counts := get(&DiscoveryFilter{Version: "v2"}); counts["green-a"] != 3 || counts["green-b"] != 3 {
+		t.Errorf("only the v2 instances must be used, got %v", counts)
+	}
+	if counts := get(&DiscoveryFilter{Tags: []string{"canary"}}); counts["green-a"] != 6 {
+		t.Errorf("only the tagged instance must be used, got %v", counts)
+	}
+	if counts := get(&DiscoveryFilter{Metadata: map[string]string{"team": "core"}}); counts["green-b"] != 6 {
+		t.Errorf("only the instance with the metadata must be used, got %v", counts)
+	}
+	if counts := get(&DiscoveryFilter{Version: "v2", Zone: "b"}); counts["green-b"] != 6 {
+		t.Errorf("the instances of the zone must be preferred, got %v", counts)
+	}
+	if counts := get(&DiscoveryFilter{Version: "v1", Zone: "b"}); counts["blue"] != 6 {
+		t.Errorf("other zones must be used when the zone has no instance, got %v", counts)
+	}
+	if counts := get(&DiscoveryFilter{Version: "v3"}); counts[`{"error":"no upstream host available"}`] != 6 {
+		t.Errorf("no instance must match, got %v", counts)
+	}
+}
+
+func TestDiscoveryWeight(t *testing.T) {
+	lb := newLoadBalancer(nil, WeightedRoundRobin, "")
+	clients := []DiscoveryClient{
+		{Service: "echo", Host: "10.0.0.1", Port: 8080, Weight: 3},
+		{Service: "echo", Host: "10.0.0.2", Port: 8080},
+	}
+	lb.sync(clients)
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		counts[lb.next("", nil).client.Host]++
+	}
+	if counts["10.0.0.1"] != 6 || counts["10.0.0.2"] != 2 {
+		t.Errorf("instances must be balanced by weight, got %v", counts)
+	}
+	host := lb.hosts[1]
+	clients[1].Weight = 3
+	lb.sync(clients)
+	if lb.hosts[1] != host || host.weight != 3 {
+		t.Errorf("a new weight must be applied to the same host, got %d", host.weight)
+	}
+}
+
+func TestDiscoveryHealthCheck(t *testing.T) {
+	var status int32 = http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			t.Errorf("unexpected health check path %s", r.URL.Path)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+	stopped := httptest.NewServer(http.NotFoundHandler())
+	stopped.Close()
+
+	s := NewDiscoveryService()
+	defer s.Stop()
+	instance := func(server *httptest.Server, path string) *DiscoveryClient {
+		host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+		client := &DiscoveryClient{Service: "echo", Host: host, HealthCheckPath: path}
+		client.Port, _ = strconv.Atoi(port)
+		return client
+	}
+	checked, down := instance(server, "/healthz"), instance(stopped, "")
+	s.AppendService(checked)
+	s.AppendService(down)
+	s.SetHealthCheck(&HealthCheck{Interval: 10, Timeout: 500, HealthyThreshold: 2, UnhealthyThreshold: 2})
+	go s.HeartBeatServices()
+	active := func(client *DiscoveryClient) func() bool {
+		return func() bool {
+			clients, _ := s.GetActiveServices("echo")
+			for i := range clients {
+				if clients[i].sameInstance(client) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	waitFor(t, func() bool { return !active(down)() }, "an instance refusing connections must be deactivated")
+	if !active(checked)() {
+		t.Error("a healthy instance must stay active")
+	}
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	waitFor(t, func() bool { return !active(checked)() }, "an instance failing its health check must be deactivated")
+	s.AppendService(checked)
+	if active(checked)() {
+		t.Error("renewing the lease must not reactivate an unhealthy instance")
+	}
+	atomic.StoreInt32(&status, http.StatusOK)
+	waitFor(t, active(checked), "a recovered instance must be reactivated")
+}
+
+func TestDiscoveryPassiveEjection(t *testing.T) {
+	s := NewDiscoveryService()
+	defer s.Stop()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	for _, server := range []*httptest.Server{healthy, failing} {
+		host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+		client := &DiscoveryClient{Service: "echo", Host: host}
+		client.Port, _ = strconv.Atoi(port)
+		s.AppendService(client)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	route := Route{Path: "/", ForwardUrl: "echo:/", AllowedMethods: []string{http.MethodGet}}
+	r.GET("/", route.GetCoreHandler(&Configuration{Discovery: true}, http.MethodGet, s))
+	failed := 0
+	for i := 0; i < 40; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusOK {
+			failed++
+		}
+		if i == 0 {
+			if clients, _ := s.GetActiveServices("echo"); len(clients) != 2 {
+				t.Error("a single failed request must not deactivate an instance")
+			}
+		}
+	}
+	if failed != 5 {
+		t.Errorf("the failing instance must be ejected after 5 failures, got %d", failed)
+	}
+}
+
+func TestDiscoveryReregistrationDuringRequests(t *testing.T) {
+	s := NewDiscoveryService()
+	defer s.Stop()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	instance := &DiscoveryClient{Service: "echo", Host: host}
+	instance.Port, _ = strconv.Atoi(port)
+	s.AppendService(instance)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	route := Route{Path: "/", ForwardUrl: "echo:/", AllowedMethods: []string{http.MethodGet}, Retry: &Retry{Attempts: 2, Backoff: 1}}
+	r.GET("/", route.GetCoreHandler(&Configuration{Discovery: true}, http.MethodGet, s))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			registration := *instance
+			registration.Weight = i%3 + 1
+			s.AppendService(&registration)
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDiscoveryWatchStop(t *testing.T) {
+	s := NewDiscoveryService()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/discovery", s.GetQueryHandler())
+	server := httptest.NewServer(r)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/discovery?watch=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	polled := make(chan string)
+	go func() {
+		resp, err := http.Get(server.URL + "/discovery?index=0&wait=60000")
+		if err != nil {
+			polled <- err.Error()
+			return
+		}
+		resp.Body.Close()
+		polled <- resp.Header.Get("X-Discovery-Index")
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.Stop()
+	done := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("the watch must end cleanly, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stopping the registry must end the watch")
+	}
+	select {
+	case index := <-polled:
+		if index != "0" {
+			t.Errorf("the long-poll must be answered, got %q", index)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stopping the registry must end the long-poll")
+	}
+}
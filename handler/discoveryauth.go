@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	discoveryCredentialKey   = "goginx.discoveryCredential"
+	discoveryTimestampHeader = "X-Discovery-Timestamp"
+	discoverySignatureScheme = "HMAC-SHA256"
+	defaultMaxClockSkew      = 5 * time.Minute
+	maxDiscoveryBodySize     = 1 << 20
+)
+
+var (
+	errMissingCredentials = errors.New("missing credentials")
+	errInvalidToken       = errors.New("invalid bearer token")
+	errInvalidSignature   = errors.New("invalid signature")
+	errExpiredSignature   = errors.New("signature timestamp is missing or too old")
+	errUnknownCertificate = errors.New("client certificate is not allowed")
+)
+
+func (a *DiscoveryAuth) validate(conf *Configuration, path string) Errors {
+	var errs Errors
+	if len(a.Credentials) == 0 {
+		errs = append(errs, conf.fieldError(path+".credentials", "discoveryAuth must have atleast one credential"))
+	}
+	if a.MaxClockSkew < 0 {
+		errs = append(errs, conf.fieldError(path+".maxClockSkew", "maxClockSkew must not be negative"))
+	}
+	if a.ClientCa != "" {
+		if _, err := loadCertPool(a.ClientCa); err != nil {
+			errs = append(errs, conf.fieldError(path+".clientCa", err.Error()))
+		}
+		if conf.Certificate == "" || conf.Key == "" {
+			errs = append(errs, conf.fieldError(path+".clientCa", "client certificates require the certificate and key to be set"))
+		}
+	}
+	names := make(map[string]bool)
+	for i, credential := range a.Credentials {
+		credentialPath := fmt.Sprintf("%s.credentials[%d]", path, i)
+		if credential.Name == "" {
+			errs = append(errs, conf.fieldError(credentialPath+".name", "credential name is not set"))
+		} else if names[credential.Name] {
+			errs = append(errs, conf.fieldError(credentialPath+".name", "duplicate credential %q", credential.Name))
+		}
+		names[credential.Name] = true
+		set := 0
+		for _, value := range []string{credential.Token, credential.HmacSecret, credential.CommonName} {
+			if value != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			errs = append(errs, conf.fieldError(credentialPath, "exactly one of token, hmacSecret and commonName must be set"))
+		}
+		if credential.CommonName != "" && a.ClientCa == "" {
+			errs = append(errs, conf.fieldError(credentialPath+".commonName", "commonName requires a clientCa"))
+		}
+		if len(credential.Services) == 0 {
+			errs = append(errs, conf.fieldError(credentialPath+".services", "credential must allow atleast one service"))
+		}
+		for j, pattern := range credential.Services {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				errs = append(errs, conf.fieldError(fmt.Sprintf("%s.services[%d]", credentialPath, j), "invalid service pattern %q", pattern))
+			}
+		}
+	}
+	return errs
+}
+
+// allows reports whether the credential may register the service.
+func (credential *DiscoveryCredential) allows(service string) bool {
+	for _, pattern := range credential.Services {
+		if ok, _ := filepath.Match(pattern, service); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// GetServerTLSConfig returns the TLS configuration asking the clients of the
+// discovery endpoint for a certificate, or nil when no clientCa is set.
+func (conf *Configuration) GetServerTLSConfig() (*tls.Config, error) {
+	if conf.DiscoveryAuth == nil || conf.DiscoveryAuth.ClientCa == "" {
+		return nil, nil
+	}
+	pool, err := loadCertPool(conf.DiscoveryAuth.ClientCa)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}, nil
+}
+
+// GetDiscoveryAuthHandler authenticates the requests to the discovery
+// endpoint. The credential found is checked against the service once the
+// instance is read; rejected requests are answered 401 and audit logged.
+func (conf *Configuration) GetDiscoveryAuthHandler() gin.HandlerFunc {
+	auth := conf.DiscoveryAuth
+	return func(c *gin.Context) {
+		credential, err := auth.authenticate(c)
+		if err != nil {
+			rejectDiscoveryRequest(c, http.StatusUnauthorized, "", nil, err)
+			return
+		}
+		c.Set(discoveryCredentialKey, credential)
+	}
+}
+
+// authenticate returns the credential presented in the Authorization header
+// or, without one, as a client certificate.
+func (a *DiscoveryAuth) authenticate(c *gin.Context) (*DiscoveryCredential, error) {
+	authorization := c.GetHeader("Authorization")
+	switch {
+	case strings.HasPrefix(authorization, "Bearer "):
+		token := []byte(strings.TrimPrefix(authorization, "Bearer "))
+		for i := range a.Credentials {
+			credential := &a.Credentials[i]
+			if credential.Token != "" && subtle.ConstantTimeCompare([]byte(credential.Token), token) == 1 {
+				return credential, nil
+			}
+		}
+		return nil, errInvalidToken
+	case strings.HasPrefix(authorization, discoverySignatureScheme+" "):
+		return a.verifySignature(c, strings.TrimPrefix(authorization, discoverySignatureScheme+" "))
+	case authorization != "":
+		return nil, errMissingCredentials
+	}
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+		return nil, errMissingCredentials
+	}
+	commonName := c.Request.TLS.VerifiedChains[0][0].Subject.CommonName
+	for i := range a.Credentials {
+		credential := &a.Credentials[i]
+		if credential.CommonName != "" && credential.CommonName == commonName {
+			return credential, nil
+		}
+	}
+	return nil, errUnknownCertificate
+}
+
+// verifySignature checks a "<name>:<signature>" value, the hex encoded
+// HMAC-SHA256 of the timestamp, method, path and body of the request each on
+// its own line, made with the secret of the named credential.
+func (a *DiscoveryAuth) verifySignature(c *gin.Context, value string) (*DiscoveryCredential, error) {
+	separator := strings.LastIndex(value, ":")
+	if separator < 0 {
+		return nil, errInvalidSignature
+	}
+	name := value[:separator]
+	signature, err := hex.DecodeString(value[separator+1:])
+	if err != nil {
+		return nil, errInvalidSignature
+	}
+	var credential *DiscoveryCredential
+	for i := range a.Credentials {
+		if a.Credentials[i].HmacSecret != "" && a.Credentials[i].Name == name {
+			credential = &a.Credentials[i]
+		}
+	}
+	if credential == nil {
+		return nil, errInvalidSignature
+	}
+	timestamp := c.GetHeader(discoveryTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errExpiredSignature
+	}
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > milliseconds(a.MaxClockSkew, defaultMaxClockSkew) {
+		return nil, errExpiredSignature
+	}
+	var body []byte
+	if c.Request.Body != nil {
+		if body, err = ioutil.ReadAll(io.LimitReader(c.Request.Body, maxDiscoveryBodySize+1)); err != nil {
+			return nil, err
+		}
+		if len(body) > maxDiscoveryBodySize {
+			return nil, errors.New("request body too large")
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if !hmac.Equal(signature, signDiscoveryRequest(credential.HmacSecret, timestamp, c.Request.Method, c.Request.URL.Path, body)) {
+		return nil, errInvalidSignature
+	}
+	return credential, nil
+}
+
+func signDiscoveryRequest(secret string, timestamp string, method string, path string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", timestamp, method, path)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// authorizeDiscoveryClient checks that the credential of an authenticated
+// request may register the service of the instance.
+func authorizeDiscoveryClient(c *gin.Context, client *DiscoveryClient) bool {
+	value, ok := c.Get(discoveryCredentialKey)
+	if !ok {
+		return true
+	}
+	credential := value.(*DiscoveryCredential)
+	if !credential.allows(client.Service) {
+		rejectDiscoveryRequest(c, http.StatusForbidden, client.Service, credential, fmt.Errorf("credential is not allowed for service %s", client.Service))
+		return false
+	}
+	return true
+}
+
+func rejectDiscoveryRequest(c *gin.Context, status int, service string, credential *DiscoveryCredential, err error) {
+	name := "anonymous"
+	if credential != nil {
+		name = credential.Name
+	}
+	log.Printf("AUDIT: discovery %s rejected: service=%q credential=%q client=%s status=%d: %v", c.Request.Method, service, name, c.ClientIP(), status, err)
+	incMetric(metricDiscoveryRejected, strconv.Itoa(status))
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+}
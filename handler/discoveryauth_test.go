@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func discoveryAuthEngine(conf *Configuration, s *DiscoveryService) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	registration := r.Group("", conf.GetDiscoveryAuthHandler())
+	registration.POST("/discovery", s.GetRegistrationHandler())
+	registration.DELETE("/discovery", s.GetDeregistrationHandler())
+	return r
+}
+
+func TestDiscoveryAuth(t *testing.T) {
+	s := NewDiscoveryService()
+	defer s.Stop()
+	conf := &Configuration{DiscoveryAuth: &DiscoveryAuth{Credentials: []DiscoveryCredential{
+		{Name: "payments", Token: "payments-token", Services: []string{"payments", "billing-*"}},
+		{Name: "ci", HmacSecret: "ci-secret", Services: []string{"*"}},
+	}}}
+	r := discoveryAuthEngine(conf, s)
+	send := func(method string, body string, header http.Header) int {
+		req := httptest.NewRequest(method, "/discovery", strings.NewReader(body))
+		req.Header = header
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+	signed := func(name string, secret string, at time.Time, method string, body string) http.Header {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		signature := hex.EncodeToString(signDiscoveryRequest(secret, timestamp, method, "/discovery", []byte(body)))
+		return http.Header{
+			"Authorization":          {"HMAC-SHA256 " + name + ":" + signature},
+			discoveryTimestampHeader: {timestamp},
+		}
+	}
+	payments := `{ "service": "payments", "host": "10.0.0.1", "port": 8080 }`
+	billing := `{ "service": "billing-eu", "host": "10.0.0.2", "port": 8080 }`
+	orders := `{ "service": "orders", "host": "10.0.0.3", "port": 8080 }`
+
+	for _, test := range []struct {
+		name   string
+		method string
+		body   string
+		header http.Header
+		status int
+	}{
+		{"no credentials", http.MethodPost, payments, http.Header{}, http.StatusUnauthorized},
+		{"unknown token", http.MethodPost, payments, bearer("wrong"), http.StatusUnauthorized},
+		{"token", http.MethodPost, payments, bearer("payments-token"), http.StatusOK},
+		{"token with pattern", http.MethodPost, billing, bearer("payments-token"), http.StatusOK},
+		{"token of another service", http.MethodPost, orders, bearer("payments-token"), http.StatusForbidden},
+		{"deregistration of another service", http.MethodDelete, orders, bearer("payments-token"), http.StatusForbidden},
+		{"signature", http.MethodPost, orders, signed("ci", "ci-secret", time.Now(), http.MethodPost, orders), http.StatusOK},
+		{"signature of another body", http.MethodPost, payments, signed("ci", "ci-secret", time.Now(), http.MethodPost, orders), http.StatusUnauthorized},
+		{"signature of another method", http.MethodDelete, orders, signed("ci", "ci-secret", time.Now(), http.MethodPost, orders), http.StatusUnauthorized},
+		{"signature with a wrong secret", http.MethodPost, orders, signed("ci", "guess", time.Now(), http.MethodPost, orders), http.StatusUnauthorized},
+		{"old signature", http.MethodPost, orders, signed("ci", "ci-secret", time.Now().Add(-time.Hour), http.MethodPost, orders), http.StatusUnauthorized},
+		{"token used as a signature", http.MethodPost, orders, signed("payments", "payments-token", time.Now(), http.MethodPost, orders), http.StatusUnauthorized},
+	} {
+		if status := send(test.method, test.body, test.header); status != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, status)
+		}
+	}
+	for _, service := range []string{"payments", "billing-eu", "orders"} {
+		if _, err := s.GetActiveServices(service); err != nil {
+			t.Errorf("%s must be registered: %v", service, err)
+		}
+	}
+}
+
+func TestDiscoveryAuthClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+	writeClientCertificate(t, certFile, keyFile, "orders.internal")
+	s := NewDiscoveryService()
+	defer s.Stop()
+	conf := &Configuration{DiscoveryAuth: &DiscoveryAuth{
+		ClientCa:    certFile,
+		Credentials: []DiscoveryCredential{{Name: "orders", CommonName: "orders.internal", Services: []string{"orders"}}},
+	}}
+	tlsConfig, err := conf.GetServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(discoveryAuthEngine(conf, s))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register := func(client *http.Client, service string) int {
+		body := `{ "service": "` + service + `", "host": "10.0.0.1", "port": 8080 }`
+		resp, err := client.Post(server.URL+"/discovery", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	withCertificate := server.Client()
+	withCertificate.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{certificate}
+	if status := register(withCertificate, "orders"); status != http.StatusOK {
+		t.Errorf("the client certificate must be accepted, got %d", status)
+	}
+	if status := register(withCertificate, "payments"); status != http.StatusForbidden {
+		t.Errorf("the client certificate must only register its services, got %d", status)
+	}
+	withoutCertificate := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	if status := register(withoutCertificate, "orders"); status != http.StatusUnauthorized {
+		t.Errorf("a client without certificate must be rejected, got %d", status)
+	}
+}
+
+func TestValidateDiscoveryAuth(t *testing.T) {
+	conf := &Configuration{}
+	auth := &DiscoveryAuth{MaxClockSkew: -1, Credentials: []DiscoveryCredential{
+		{Name: "a", Token: "t", HmacSecret: "s", Services: []string{"*"}},
+		{Name: "a", CommonName: "b", Services: []string{"["}},
+		{Token: "t"},
+	}}
+	errs := auth.validate(conf, "discoveryAuth")
+	for _, expected := range []string{
+		"maxClockSkew must not be negative",
+		"discoveryAuth.credentials[0]: exactly one of token, hmacSecret and commonName must be set",
+		`duplicate credential "a"`,
+		"commonName requires a clientCa",
+		`invalid service pattern "["`,
+		"discoveryAuth.credentials[2].name: credential name is not set",
+		"credential must allow atleast one service",
+	} {
+		if !strings.Contains(errs.Error(), expected) {
+			t.Errorf("expected %q, got %v", expected, errs)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package handler
+
+import "strings"
+
+// FieldError is a configuration problem tied to the JSON path of a field
+// and, when known, the file:line:column it was read from.
+type FieldError struct {
+	Location string
+	Path     string
+	Message  string
+}
+
+func (e *FieldError) Error() string {
+	message := e.Message
+	if e.Path != "" {
+		message = e.Path + ": " + message
+	}
+	if e.Location != "" {
+		message = e.Location + ": " + message
+	}
+	return message
+}
+
+// Errors collects every problem found in a configuration.
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Locate returns the location of path, or of its closest parent when the
+// field itself was not present in the file (e.g. a missing required field).
+func (l Locations) Locate(path string) string {
+	for path != "" {
+		if location, ok := l[path]; ok {
+			return location
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return l[""]
+}
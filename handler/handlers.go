@@ -2,10 +2,12 @@ package handler
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -14,41 +16,75 @@ import (
 )
 
 func (route Route) GetCoreHandler(conf *Configuration, method string, discoveryService *DiscoveryService) gin.HandlerFunc {
-	rr, _ := conf.getLoadBalancer(route)
-	ds := func() *DiscoveryClient {
-		client, _ := discoveryService.GetService(route.ForwardUrl[0:strings.Index(route.ForwardUrl, ":")])
-		return client
-	}
-	next := func() (*DiscoveryClient, string) {
-		if conf.Discovery {
-			ds := ds()
-			host, port := ds.Host, ds.Port
-			return ds, net.JoinHostPort(host, strconv.Itoa(port))
-		} else {
-			return nil, rr.Next().Host
+	lb, _ := conf.getLoadBalancer(route)
+	client := conf.getClient(route)
+	tlsConfig := conf.getTLSConfig(route)
+	discovered := conf.isDiscoveryRoute(route)
+	budget := conf.getRetryBudget()
+	next := func(c *gin.Context, exclude map[*upstreamHost]bool) (*upstreamHost, error) {
+		if discovered {
+			clients, err := discoveryService.GetActiveServices(route.forwardScheme())
+			if err != nil {
+				return nil, err
+			}
+			lb.sync(clients)
+			if filter := route.Discovery; filter != nil {
+				exclude = lb.excluding(exclude, filter.matches)
+				if filter.Zone != "" {
+					inZone := func(client *DiscoveryClient) bool { return client.Zone == filter.Zone }
+					if host := lb.next(lb.hashKey(c), lb.excluding(exclude, inZone)); host != nil {
+						return host, nil
+					}
+				}
+			}
 		}
+		host := lb.next(lb.hashKey(c), exclude)
+		if host == nil {
+			return nil, errNoUpstreamHost
+		}
+		return host, nil
 	}
 	return func(c *gin.Context) {
-		body, err := ioutil.ReadAll(c.Request.Body)
-		if checkAndSendError(c, err) {
+		if route.MaxBodySize > 0 && c.Request.ContentLength > route.MaxBodySize {
+			sendBodyTooLarge(c)
 			return
 		}
-		ds, host := next()
-		url := strings.TrimRight(host, "/")
-		if route.AppendPath {
-			url += c.Request.URL.Path
+		var body *maxBodyReader
+		if route.MaxBodySize > 0 {
+			body = newMaxBodyReader(c.Request.Body, route.MaxBodySize)
+			c.Request.Body = body
 		}
-		proxyReq, err := http.NewRequest(method, url+"?"+c.Request.URL.RawQuery, bytes.NewReader(body))
-		if checkAndSendError(c, err) {
+		var buffered []byte
+		if route.Retry.enabled(method) && !isUpgradeRequest(c.Request) && c.Request.ContentLength != 0 {
+			var err error
+			if buffered, err = ioutil.ReadAll(c.Request.Body); err != nil && body != nil && body.Exceeded() {
+				sendBodyTooLarge(c)
+				return
+			} else if checkAndSendError(c, err) {
+				return
+			}
+			c.Request.Body = ioutil.NopCloser(bytes.NewReader(buffered))
+			c.Request.ContentLength = int64(len(buffered))
+		}
+		host, err := next(c, nil)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 			return
 		}
-		if route.ForwardIp {
-			proxyReq.Header.Add("X-Forwarded-For", c.ClientIP())
+		release := host.acquire()
+		defer func() {
+			release()
+		}()
+		proxyReq, err := http.NewRequestWithContext(c.Request.Context(), method, route.targetUrl(lb, host, c), c.Request.Body)
+		if checkAndSendError(c, err) {
+			return
 		}
-		proxyReq.Header = make(http.Header)
-		for h, val := range c.Request.Header {
-			proxyReq.Header.Add(h, val[0])
+		proxyReq.ContentLength = c.Request.ContentLength
+		if proxyReq.ContentLength == 0 {
+			proxyReq.Body = http.NoBody
 		}
+		proxyReq.Header = forwardRequestHeader(c.Request)
+		route.addForwardedHeaders(c, proxyReq.Header)
 		if route.SecureHeaders {
 			route.addSecureHeaders(c)
 		}
@@ -56,39 +92,85 @@ func (route Route) GetCoreHandler(conf *Configuration, method string, discoveryS
 		for h, val := range route.CustomHeaders {
 			proxyReq.Header.Add(h, val)
 		}
-		resp, err := http.DefaultClient.Do(proxyReq)
-		if checkAndSendError(c, err) {
-			if ds != nil {
-				discoveryService.MarkInactive(ds)
+		if isUpgradeRequest(c.Request) {
+			err := route.proxyUpgrade(c, proxyReq, tlsConfig)
+			host.report(err != nil)
+			if err != nil {
+				checkAndSendError(c, err)
 			}
 			return
 		}
-
-		respHeaders := make(map[string]string)
-		for h, vals := range resp.Header {
-			respHeaders[h] = vals[0]
+		if client != http.DefaultClient {
+			proxyReq = traceConnectionReuse(proxyReq, route.forwardScheme())
 		}
-		defer resp.Body.Close()
-		c.DataFromReader(resp.StatusCode, resp.ContentLength, resp.Header.Get("Content-Type"), resp.Body, respHeaders)
-		for _, cookie := range resp.Cookies() {
-			c.Writer.Header().Add("Set-Cookie", cookie.String())
+		budget.request()
+		tried := make(map[*upstreamHost]bool)
+		var resp *http.Response
+		for attempt := 1; ; attempt++ {
+			tryReq, timeout, cancel := route.Retry.withTimeout(proxyReq)
+			defer cancel()
+			resp, err = client.Do(tryReq)
+			timedOut := timeout.stop()
+			if timedOut && err != nil {
+				err = fmt.Errorf("perTryTimeout expired: %w", err)
+			}
+			if err != nil && body != nil && body.Exceeded() {
+				sendBodyTooLarge(c)
+				return
+			}
+			if c.Request.Context().Err() != nil {
+				break
+			}
+			host.report(err != nil || resp.StatusCode >= http.StatusInternalServerError)
+			if buffered == nil && proxyReq.Body != http.NoBody || !route.Retry.enabled(method) || attempt >= route.Retry.Attempts || !route.Retry.retryable(timedOut, resp, err) {
+				break
+			}
+			tried[host] = true
+			retryHost, nextErr := next(c, tried)
+			if nextErr != nil {
+				// Every host was tried: retry on any of them.
+				if retryHost, nextErr = next(c, nil); nextErr != nil {
+					break
+				}
+			}
+			if !budget.withdraw() {
+				retryHost.breaker.release()
+				break
+			}
+			if err == nil {
+				resp.Body.Close()
+			}
+			release()
+			host, release = retryHost, retryHost.acquire()
+			if !route.Retry.wait(c.Request.Context(), attempt) {
+				return
+			}
+			proxyReq = proxyReq.Clone(proxyReq.Context())
+			if proxyReq.URL, err = url.Parse(route.targetUrl(lb, host, c)); checkAndSendError(c, err) {
+				return
+			}
+			proxyReq.Host = proxyReq.URL.Host
+			if buffered != nil {
+				proxyReq.Body = ioutil.NopCloser(bytes.NewReader(buffered))
+			}
+		}
+		if checkAndSendError(c, err) {
+			return
 		}
+
+		defer resp.Body.Close()
+		forwardResponseHeader(c.Writer.Header(), resp)
+		c.DataFromReader(resp.StatusCode, resp.ContentLength, resp.Header.Get("Content-Type"), resp.Body, nil)
 	}
 }
 
-func (conf Configuration) GetWhitelistHandler() gin.HandlerFunc {
-	whiteList := make(map[string]bool)
-	for _, ip := range conf.WhiteList {
-		whiteList[ip] = true
-	}
-	return func(c *gin.Context) {
-		for _, ip := range conf.WhiteList {
-			if whiteList[c.ClientIP()] || cidrRangeContains(ip, c.ClientIP()) {
-				return
-			}
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": c.ClientIP() + " is not allowed"})
-		}
+// targetUrl returns the URL a request is forwarded to on the given host.
+func (route Route) targetUrl(lb *routeBalancer, host *upstreamHost, c *gin.Context) string {
+	target := strings.TrimRight(lb.target(host), "/")
+	if route.AppendPath {
+		target += c.Request.URL.Path
 	}
+	return target + "?" + c.Request.URL.RawQuery
 }
 
 func (conf Configuration) GetLoggingHandler() gin.HandlerFunc {
@@ -109,27 +191,171 @@ func (conf Configuration) GetLoggingHandler() gin.HandlerFunc {
 }
 
 func (conf Configuration) GetDiscoveryHandler() (gin.HandlerFunc, *DiscoveryService) {
-	service := &DiscoveryService{}
+	service := NewDiscoveryService()
+	service.SetHealthCheck(conf.DiscoveryHealthCheck)
 	go service.HeartBeatServices()
+	return service.GetRegistrationHandler(), service
+}
+
+// bindDiscoveryClient reads and checks the instance sent to the discovery
+// endpoint, answering 400 when it is invalid and 403 when the credential of
+// the request may not register its service.
+func bindDiscoveryClient(c *gin.Context) (*DiscoveryClient, bool) {
+	client := &DiscoveryClient{}
+	if err := c.ShouldBind(client); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if client.Service == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "service name is required"})
+		return nil, false
+	}
+	if client.Host == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "service host is required"})
+		return nil, false
+	}
+	if client.Port < 1 || client.Port > 65535 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "service port is invalid"})
+		return nil, false
+	}
+	if client.Ttl < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "service ttl must not be negative"})
+		return nil, false
+	}
+	if client.Weight < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "service weight must not be negative"})
+		return nil, false
+	}
+	if client.HealthCheckPath != "" && !strings.HasPrefix(client.HealthCheckPath, "/") {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "service healthCheckPath must start with /"})
+		return nil, false
+	}
+	if !authorizeDiscoveryClient(c, client) {
+		return nil, false
+	}
+	return client, true
+}
+
+func (service *DiscoveryService) GetRegistrationHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		client := &DiscoveryClient{}
-		if err := c.Bind(&client); err != nil {
-			c.AbortWithError(http.StatusBadRequest, err)
+		client, ok := bindDiscoveryClient(c)
+		if !ok {
 			return
 		}
-		if client.Service == "" {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "service name is required"})
+		service.AppendService(client)
+	}
+}
+
+func (service *DiscoveryService) GetDeregistrationHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, ok := bindDiscoveryClient(c)
+		if !ok {
 			return
 		}
-		if client.Host == "" {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "service host is required"})
-			return
+		if err := service.RemoveService(client); err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		}
-		if client.Port < 1 || client.Port > 65535 {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "service port is invalid"})
+	}
+}
+
+const (
+	defaultWatchWait = 30 * time.Second
+	maxWatchWait     = 5 * time.Minute
+	watchKeepAlive   = 15 * time.Second
+)
+
+// GetQueryHandler lists the registered instances of every service, or of the
+// service named in the path. A request carrying the index of a previous
+// answer is held until the registry changes or the wait, in milliseconds,
+// elapses. With watch=true or an Accept of text/event-stream, every change is
+// streamed as a server-sent event instead.
+func (service *DiscoveryService) GetQueryHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("service")
+		if c.Query("watch") == "true" || strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+			service.streamInstances(c, name)
 			return
 		}
-		client.Active = true
-		service.AppendService(client)
-	}, service
+		revision, services, changed := service.Instances(name)
+		if index := c.Query("index"); index != "" {
+			last, err := strconv.ParseUint(index, 10, 64)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "index is invalid"})
+				return
+			}
+			wait := defaultWatchWait
+			if value := c.Query("wait"); value != "" {
+				ms, err := strconv.Atoi(value)
+				if err != nil || ms < 0 {
+					c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "wait is invalid"})
+					return
+				}
+				wait = time.Duration(ms) * time.Millisecond
+			}
+			if wait > maxWatchWait {
+				wait = maxWatchWait
+			}
+			if last >= revision {
+				timer := time.NewTimer(wait)
+				select {
+				case <-changed:
+				case <-timer.C:
+				case <-service.stop:
+				case <-c.Request.Context().Done():
+					timer.Stop()
+					return
+				}
+				timer.Stop()
+				revision, services, _ = service.Instances(name)
+			}
+		}
+		c.Header("X-Discovery-Index", strconv.FormatUint(revision, 10))
+		c.JSON(http.StatusOK, discoveryResponse(name, revision, services))
+	}
+}
+
+// streamInstances sends the instances as server-sent events, once right away
+// and then on every change of the registry, until the client goes away.
+func (service *DiscoveryService) streamInstances(c *gin.Context, name string) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	var changed <-chan struct{}
+	c.Stream(func(w io.Writer) bool {
+		if changed != nil {
+			select {
+			case <-changed:
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+				return true
+			case <-service.stop:
+				return false
+			case <-c.Request.Context().Done():
+				return false
+			}
+		}
+		var revision uint64
+		var services map[string][]DiscoveryClient
+		revision, services, changed = service.Instances(name)
+		data, err := json.Marshal(discoveryResponse(name, revision, services))
+		if err != nil {
+			return false
+		}
+		fmt.Fprintf(w, "id: %d\nevent: services\ndata: %s\n\n", revision, data)
+		return true
+	})
+}
+
+func discoveryResponse(name string, revision uint64, services map[string][]DiscoveryClient) gin.H {
+	if name == "" {
+		return gin.H{"index": revision, "services": services}
+	}
+	instances := services[name]
+	if instances == nil {
+		instances = []DiscoveryClient{}
+	}
+	return gin.H{"index": revision, "service": name, "instances": instances}
 }
@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hopHeaders are the hop-by-hop headers of RFC 7230, section 6.1, which are
+// meaningful for a single connection only and are not forwarded by proxies.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// copyHeader adds every value of every header of src to dst.
+func copyHeader(dst http.Header, src http.Header) {
+	for h, vals := range src {
+		for _, val := range vals {
+			dst.Add(h, val)
+		}
+	}
+}
+
+// removeHopHeaders removes the hop-by-hop headers from header, including the
+// ones named in its Connection header.
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// forwardRequestHeader returns the headers of an incoming request to send to
+// the upstream. The Upgrade and Connection headers of upgrade requests are
+// kept so that the upstream can switch protocols, and "TE: trailers" is kept
+// so that it may answer with trailers.
+func forwardRequestHeader(r *http.Request) http.Header {
+	header := make(http.Header, len(r.Header))
+	copyHeader(header, r.Header)
+	removeHopHeaders(header)
+	if isUpgradeRequest(r) {
+		header.Set("Connection", "Upgrade")
+		header.Set("Upgrade", r.Header.Get("Upgrade"))
+	}
+	for _, value := range r.Header.Values("Te") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(textproto.TrimString(token), "trailers") {
+				header.Set("Te", "trailers")
+			}
+		}
+	}
+	return header
+}
+
+// forwardResponseHeader copies the end-to-end headers of an upstream response
+// to the headers sent to the client, replacing the values goginx set itself.
+func forwardResponseHeader(dst http.Header, resp *http.Response) {
+	header := resp.Header.Clone()
+	removeHopHeaders(header)
+	for h := range header {
+		dst.Del(h)
+	}
+	copyHeader(dst, header)
+}
+
+const (
+	ForwardedNone       = "none"
+	ForwardedXForwarded = "xForwarded"
+	ForwardedRFC7239    = "forwarded"
+	ForwardedAll        = "all"
+)
+
+// forwardedMode returns the forwardedHeaders mode of the route. forwardIp is
+// the older spelling of xForwarded.
+func (route Route) forwardedMode() string {
+	if route.ForwardedHeaders == "" {
+		if route.ForwardIp {
+			return ForwardedXForwarded
+		}
+		return ForwardedNone
+	}
+	return route.ForwardedHeaders
+}
+
+// addForwardedHeaders tells the upstream about the client and the original
+// request: X-Forwarded-For, -Proto, -Host and -Port, the Forwarded header of
+// RFC 7239, or both, depending on the forwardedHeaders mode of the route. The
+// address of the peer is appended to the chain set by previous proxies and
+// goginx adds itself to Via.
+func (route Route) addForwardedHeaders(c *gin.Context, header http.Header) {
+	mode := route.forwardedMode()
+	if mode == ForwardedNone {
+		return
+	}
+	clientIP, _, err := net.SplitHostPort(peerAddr(c))
+	if err != nil {
+		clientIP = peerAddr(c)
+	}
+	proto := "http"
+	if c.Request.TLS != nil {
+		proto = "https"
+	}
+	host := c.Request.Host
+	port := ""
+	if _, p, err := net.SplitHostPort(host); err == nil {
+		port = p
+	} else if addr, ok := c.Request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		_, port, _ = net.SplitHostPort(addr.String())
+	} else if proto == "https" {
+		port = "443"
+	} else {
+		port = "80"
+	}
+	if mode == ForwardedXForwarded || mode == ForwardedAll {
+		appendHeader(header, "X-Forwarded-For", clientIP)
+		header.Set("X-Forwarded-Proto", proto)
+		header.Set("X-Forwarded-Host", host)
+		header.Set("X-Forwarded-Port", port)
+	}
+	if mode == ForwardedRFC7239 || mode == ForwardedAll {
+		node := clientIP
+		if strings.Contains(node, ":") {
+			node = `"[` + node + `]"`
+		}
+		appendHeader(header, "Forwarded", "for="+node+";host="+quoteForwarded(host)+";proto="+proto)
+	}
+	appendHeader(header, "Via", fmt.Sprintf("%d.%d goginx", c.Request.ProtoMajor, c.Request.ProtoMinor))
+}
+
+// appendHeader appends value to the comma separated list of a header.
+func appendHeader(header http.Header, name string, value string) {
+	if prior := header.Values(name); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	header.Set(name, value)
+}
+
+// quoteForwarded quotes a value of the Forwarded header unless it is a token.
+func quoteForwarded(value string) string {
+	for _, r := range value {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	return value
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestForwardHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accept := r.Header.Values("Accept"); !reflect.DeepEqual(accept, []string{"text/html", "application/json"}) {
+			t.Errorf("every Accept value must be forwarded, got %v", accept)
+		}
+		for _, h := range []string{"Keep-Alive", "X-Hop", "Proxy-Authorization", "Upgrade"} {
+			if r.Header.Get(h) != "" {
+				t.Errorf("hop-by-hop header %s must not be forwarded", h)
+			}
+		}
+		if r.Header.Get("Te") != "trailers" {
+			t.Errorf("TE: trailers must be forwarded, got %q", r.Header.Get("Te"))
+		}
+		if r.Header.Get("X-End-To-End") != "kept" {
+			t.Error("end-to-end headers must be forwarded")
+		}
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.Header().Add("Vary", "Accept")
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Connection", "X-Internal")
+		w.Header().Set("X-Internal", "secret")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	conf := &Configuration{}
+	route := Route{Path: "/", ForwardUrl: upstream.URL + "/", AllowedMethods: []string{"GET"}}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", route.GetCoreHandler(conf, "GET", nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Accept", "text/html")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("Connection", "keep-alive, X-Hop")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	req.Header.Set("Te", "trailers, deflate")
+	req.Header.Set("X-End-To-End", "kept")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if cookies := w.Header().Values("Set-Cookie"); !reflect.DeepEqual(cookies, []string{"a=1", "b=2"}) {
+		t.Errorf("every Set-Cookie must be forwarded once, got %v", cookies)
+	}
+	if vary := w.Header().Values("Vary"); !reflect.DeepEqual(vary, []string{"Accept", "Origin"}) {
+		t.Errorf("every Vary value must be forwarded, got %v", vary)
+	}
+	for _, h := range []string{"Connection", "X-Internal", "Keep-Alive"} {
+		if w.Header().Get(h) != "" {
+			t.Errorf("hop-by-hop header %s must not be returned", h)
+		}
+	}
+}
+
+func TestForwardUpgradeHeaders(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	header := forwardRequestHeader(req)
+	if header.Get("Connection") != "Upgrade" || header.Get("Upgrade") != "websocket" || header.Get("Sec-WebSocket-Key") == "" {
+		t.Errorf("upgrade requests must keep their Upgrade and Connection headers, got %v", header)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	for _, test := range []struct {
+		route    Route
+		expected map[string]string
+	}{
+		{Route{ForwardIp: true}, map[string]string{
+			"X-Forwarded-For":   "203.0.113.7, 192.0.2.1",
+			"X-Forwarded-Proto": "http",
+			"X-Forwarded-Host":  "example.com:8080",
+			"X-Forwarded-Port":  "8080",
+			"Forwarded":         "for=203.0.113.7",
+			"Via":               "1.0 edge, 1.1 goginx",
+		}},
+		{Route{ForwardedHeaders: ForwardedRFC7239}, map[string]string{
+			"X-Forwarded-For": "203.0.113.7",
+			"Forwarded":       `for=203.0.113.7, for=192.0.2.1;host="example.com:8080";proto=http`,
+		}},
+		{Route{}, map[string]string{
+			"X-Forwarded-For": "203.0.113.7",
+			"Via":             "1.0 edge",
+		}},
+	} {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for h, expected := range test.expected {
+				if r.Header.Get(h) != expected {
+					t.Errorf("%s: expected %q, got %q", h, expected, r.Header.Get(h))
+				}
+			}
+		}))
+		test.route.Path = "/"
+		test.route.ForwardUrl = upstream.URL + "/"
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		r.GET("/", test.route.GetCoreHandler(&Configuration{}, "GET", nil))
+		req := httptest.NewRequest(http.MethodGet, "http://example.com:8080/", nil)
+		req.RemoteAddr = "192.0.2.1:5555"
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.Header.Set("Forwarded", "for=203.0.113.7")
+		req.Header.Set("Via", "1.0 edge")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		upstream.Close()
+	}
+}
+
+func TestForwardedIPv6(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	c.Request.RemoteAddr = "[2001:db8::1]:5555"
+	header := make(http.Header)
+	Route{ForwardedHeaders: ForwardedAll}.addForwardedHeaders(c, header)
+	if header.Get("Forwarded") != `for="[2001:db8::1]";host=example.com;proto=https` {
+		t.Errorf("unexpected Forwarded header %q", header.Get("Forwarded"))
+	}
+	if header.Get("X-Forwarded-For") != "2001:db8::1" || header.Get("X-Forwarded-Port") != "443" {
+		t.Errorf("unexpected X-Forwarded headers %v", header)
+	}
+}
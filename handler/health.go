@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// parseStatusRange parses an expected status such as "200" or "200-399".
+func parseStatusRange(expected string) (int, int, error) {
+	if expected == "" {
+		return 200, 399, nil
+	}
+	bounds := strings.SplitN(expected, "-", 2)
+	low, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid expectedStatus %q", expected)
+	}
+	high := low
+	if len(bounds) == 2 {
+		if high, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+			return 0, 0, fmt.Errorf("invalid expectedStatus %q", expected)
+		}
+	}
+	if low < 100 || high > 599 || low > high {
+		return 0, 0, fmt.Errorf("invalid expectedStatus %q", expected)
+	}
+	return low, high, nil
+}
+
+func (h *HealthCheck) validate(conf *Configuration, path string) Errors {
+	var errs Errors
+	if !strings.HasPrefix(h.Path, "/") {
+		errs = append(errs, conf.fieldError(path+".path", "health check path must start with /"))
+	}
+	return append(errs, h.validateSettings(conf, path)...)
+}
+
+// validateSettings checks everything but the path, which the discovered
+// instances may register themselves.
+func (h *HealthCheck) validateSettings(conf *Configuration, path string) Errors {
+	errs := conf.nonNegative(path,
+		setting{"interval", h.Interval},
+		setting{"timeout", h.Timeout},
+		setting{"healthyThreshold", h.HealthyThreshold},
+		setting{"unhealthyThreshold", h.UnhealthyThreshold},
+	)
+	if _, _, err := parseStatusRange(h.ExpectedStatus); err != nil {
+		errs = append(errs, conf.fieldError(path+".expectedStatus", err.Error()))
+	}
+	return errs
+}
+
+func threshold(value int, fallback int) int {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// startHealthChecks probes every host of the upstream until the upstream is
+// closed.
+func (u *Upstream) startHealthChecks(name string, hosts []*upstreamHost) {
+	if u.HealthCheck == nil {
+		return
+	}
+	client := &http.Client{
+		Transport: u.getTransport(name),
+		Timeout:   milliseconds(u.HealthCheck.Timeout, 2*time.Second),
+	}
+	for _, host := range hosts {
+		setMetric(metricUpstreamHostHealthy, 1, name, host.url)
+		go u.HealthCheck.run(name, host, client, u.stop)
+	}
+}
+
+func (u *Upstream) stopHealthChecks() {
+	u.stopOnce.Do(func() {
+		if u.stop != nil {
+			close(u.stop)
+		}
+	})
+}
+
+func (h *HealthCheck) run(upstream string, host *upstreamHost, client *http.Client, stop chan struct{}) {
+	low, high, _ := parseStatusRange(h.ExpectedStatus)
+	healthyThreshold := threshold(h.HealthyThreshold, 2)
+	unhealthyThreshold := threshold(h.UnhealthyThreshold, 3)
+	ticker := time.NewTicker(milliseconds(h.Interval, 10*time.Second))
+	defer ticker.Stop()
+	successes, failures := 0, 0
+	for {
+		err := h.check(host, client, low, high, stop)
+		if err == nil {
+			failures = 0
+			successes++
+			if !host.healthy() && successes >= healthyThreshold {
+				atomic.StoreInt32(&host.unhealthy, 0)
+				setMetric(metricUpstreamHostHealthy, 1, upstream, host.url)
+				log.Printf("upstream %s: host %s is healthy", upstream, host.url)
+			}
+		} else {
+			successes = 0
+			failures++
+			if host.healthy() && failures >= unhealthyThreshold {
+				atomic.StoreInt32(&host.unhealthy, 1)
+				setMetric(metricUpstreamHostHealthy, 0, upstream, host.url)
+				log.Printf("upstream %s: host %s is unhealthy: %v", upstream, host.url, err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *HealthCheck) check(host *upstreamHost, client *http.Client, low int, high int, stop chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(host.url, "/")+h.Path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < low || resp.StatusCode > high {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, condition func() bool, message string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	var status int32 = http.StatusOK
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			t.Errorf("unexpected health check path %s", r.URL.Path)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer upstream.Close()
+
+	conf := &Configuration{
+		Upstreams: map[string]*Upstream{
+			"test": {
+				Hosts: []UpstreamHost{{Url: upstream.URL}},
+				HealthCheck: &HealthCheck{
+					Path:               "/healthz",
+					Interval:           10,
+					HealthyThreshold:   2,
+					UnhealthyThreshold: 2,
+				},
+			},
+		},
+	}
+	defer conf.Close()
+	lb, _ := conf.getLoadBalancer(Route{ForwardUrl: "test:/"})
+	if lb.Next() == nil {
+		t.Fatal("hosts must be healthy until checked")
+	}
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	waitFor(t, func() bool { return lb.Next() == nil }, "a failing host must be taken out of rotation")
+	atomic.StoreInt32(&status, http.StatusNoContent)
+	waitFor(t, func() bool { return lb.Next() != nil }, "a recovered host must be put back in rotation")
+}
+
+func TestValidateHealthCheck(t *testing.T) {
+	conf := Configuration{
+		Upstreams: map[string]*Upstream{
+			"test": {
+				Hosts:       []UpstreamHost{{Url: "http://localhost:8080"}},
+				HealthCheck: &HealthCheck{Path: "healthz", Interval: -1, ExpectedStatus: "300-200"},
+			},
+		},
+		Routes: []Route{{Path: "/", ForwardUrl: "test:/", AllowedMethods: []string{"GET"}}},
+	}
+	err := conf.Validate()
+	for _, expected := range []string{"health check path must start with /", "interval must not be negative", `invalid expectedStatus "300-200"`} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestValidateDiscoveryHealthCheck(t *testing.T) {
+	conf := Configuration{
+		Listen:               ":8080",
+		Log:                  "goginx.log",
+		Discovery:            true,
+		DiscoveryHealthCheck: &HealthCheck{Timeout: -1},
+		Routes:               []Route{{Path: "/", ForwardUrl: "echo:/", AllowedMethods: []string{"GET"}}},
+	}
+	if err := conf.Validate(); err == nil || !strings.Contains(err.Error(), "discoveryHealthCheck.timeout: timeout must not be negative") {
+		t.Errorf("expected a negative timeout error, got %v", err)
+	}
+	conf.DiscoveryHealthCheck = &HealthCheck{}
+	if err := conf.Validate(); err != nil {
+		t.Errorf("the path of the discovery health check is optional, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"sync"
+
+	"github.com/penglongli/gin-metrics/ginmetrics"
+)
+
+const (
+	metricUpgradeConnections       = "goginx_upgrade_connections"
+	metricUpgradeConnectionsTotal  = "goginx_upgrade_connections_total"
+	metricUpstreamConnectionsOpen  = "goginx_upstream_connections_open"
+	metricUpstreamConnectionsTotal = "goginx_upstream_connections_total"
+	metricUpstreamConnectionReuse  = "goginx_upstream_connection_reuse_total"
+	metricUpstreamHostHealthy      = "goginx_upstream_host_healthy"
+	metricAccessDenied             = "goginx_access_denied_total"
+	metricDiscoveryRejected        = "goginx_discovery_rejected_total"
+)
+
+var registerMetricsOnce sync.Once
+
+// RegisterMetrics adds the goginx specific metrics to the monitor that serves
+// /metrics. It is safe to call on every configuration reload.
+func RegisterMetrics(m *ginmetrics.Monitor) {
+	registerMetricsOnce.Do(func() {
+		_ = m.AddMetric(&ginmetrics.Metric{
+			Type:        ginmetrics.Gauge,
+			Name:        metricUpgradeConnections,
+			Description: "currently open upgraded (WebSocket) connections.",
+			Labels:      []string{"route"},
+		})
+		_ = m.AddMetric(&ginmetrics.Metric{
+			Type:        ginmetrics.Counter,
+			Name:        metricUpgradeConnectionsTotal,
+			Description: "upgraded (WebSocket) connections handled.",
+			Labels:      []string{"route"},
+		})
+		_ = m.AddMetric(&ginmetrics.Metric{
+			Type:        ginmetrics.Gauge,
+			Name:        metricUpstreamConnectionsOpen,
+			Description: "currently open connections to the hosts of an upstream.",
+			Labels:      []string{"upstream"},
+		})
+		_ = m.AddMetric(&ginmetrics.Metric{
+			Type:        ginmetrics.Counter,
+			Name:        metricUpstreamConnectionsTotal,
+			Description: "connections dialed to the hosts of an upstream.",
+			Labels:      []string{"upstream"},
+		})
+		_ = m.AddMetric(&ginmetrics.Metric{
+			Type:        ginmetrics.Counter,
+			Name:        metricUpstreamConnectionReuse,
+			Description: "requests sent to an upstream, by whether a pooled connection was reused.",
+			Labels:      []string{"upstream", "reused"},
+		})
+		_ = m.AddMetric(&ginmetrics.Metric{
+			Type:        ginmetrics.Gauge,
+			Name:        metricUpstreamHostHealthy,
+			Description: "whether a host of an upstream passes its health checks (1) or not (0).",
+			Labels:      []string{"upstream", "host"},
+		})
+		_ = m.AddMetric(&ginmetrics.Metric{
+			Type:        ginmetrics.Counter,
+			Name:        metricAccessDenied,
+			Description: "requests denied by the access rules, global or of a route.",
+			Labels:      []string{"scope"},
+		})
+		_ = m.AddMetric(&ginmetrics.Metric{
+			Type:        ginmetrics.Counter,
+			Name:        metricDiscoveryRejected,
+			Description: "registrations and deregistrations rejected by the discovery authentication.",
+			Labels:      []string{"status"},
+		})
+	})
+}
+
+func incMetric(name string, labels ...string) {
+	_ = ginmetrics.GetMonitor().GetMetric(name).Inc(labels)
+}
+
+func addMetric(name string, value float64, labels ...string) {
+	_ = ginmetrics.GetMonitor().GetMetric(name).Add(labels, value)
+}
+
+func setMetric(name string, value float64, labels ...string) {
+	_ = ginmetrics.GetMonitor().GetMetric(name).SetGaugeValue(labels, value)
+}
@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds the time a connection may take to send its PROXY
+// protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyListener accepts connections that start with a PROXY protocol (v1 or
+// v2) header, as sent by load balancers such as HAProxy or AWS NLB, and
+// reports the client address of the header as their remote address.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// NewProxyProtocolListener wraps ln so that connections carry a PROXY
+// protocol header. When trustedProxies is set, only connections from those
+// proxies are expected to send one; the others are served as they are.
+func (conf *Configuration) NewProxyProtocolListener(ln net.Listener) net.Listener {
+	trusted, _ := parseCIDRs(conf.TrustedProxies)
+	return &proxyListener{Listener: ln, trusted: trusted}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, trusted: l.trusted}, nil
+}
+
+// proxyConn reads the PROXY header lazily, from the goroutine serving the
+// connection, so that a slow client can not block the accept loop.
+type proxyConn struct {
+	net.Conn
+	trusted []*net.IPNet
+	once    sync.Once
+	reader  *bufio.Reader
+	remote  net.Addr
+	err     error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		if addr, ok := c.remote.(*net.TCPAddr); ok && len(c.trusted) > 0 && !containsIP(c.trusted, addr.IP) {
+			return
+		}
+		c.reader = bufio.NewReader(c.Conn)
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		remote, err := readProxyHeader(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.err = fmt.Errorf("%s: %w", c.remote, err)
+			return
+		}
+		if remote != nil {
+			c.remote = remote
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.reader != nil {
+		return c.reader.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// readProxyHeader reads a PROXY protocol header and returns the source
+// address it carries, or nil for connections made by the proxy itself
+// (UNKNOWN or LOCAL).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	signature, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(signature, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	slice, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	line := string(slice)
+	if len(line) > 107 || !strings.HasPrefix(line, "PROXY ") || !strings.HasSuffix(line, "\r\n") {
+		return nil, errInvalidProxyHeader
+	}
+	fields := strings.Fields(line)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errInvalidProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errInvalidProxyHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	switch header[12] & 0x0f {
+	case 0x0:
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, errInvalidProxyHeader
+	}
+	switch header[13] >> 4 {
+	case 0x1:
+		if len(payload) < 12 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2:
+		if len(payload) < 36 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,203 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	retryOnConnectFailure = "connect-failure"
+	retryOnTimeout        = "timeout"
+)
+
+var defaultRetryOn = []string{retryOnConnectFailure, "502", "503", "504"}
+
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+func (r *Retry) validate(conf *Configuration, path string) Errors {
+	errs := conf.nonNegative(path,
+		setting{"attempts", r.Attempts},
+		setting{"perTryTimeout", r.PerTryTimeout},
+		setting{"backoff", r.Backoff},
+		setting{"maxBackoff", r.MaxBackoff},
+	)
+	for i, retryOn := range r.RetryOn {
+		switch retryOn {
+		case retryOnConnectFailure, retryOnTimeout, "502", "503", "504":
+		default:
+			errs = append(errs, conf.fieldError(path+".retryOn["+strconv.Itoa(i)+"]", "retryOn must be connect-failure, timeout, 502, 503 or 504"))
+		}
+	}
+	return errs
+}
+
+func (b *RetryBudget) validate(conf *Configuration, path string) Errors {
+	var errs Errors
+	if b.Percent < 0 || b.Percent > 100 {
+		errs = append(errs, conf.fieldError(path+".percent", "percent must be between 0 and 100"))
+	}
+	if b.MinRetriesPerSecond < 0 {
+		errs = append(errs, conf.fieldError(path+".minRetriesPerSecond", "minRetriesPerSecond must not be negative"))
+	}
+	return errs
+}
+
+// enabled reports whether requests with method may be retried, in which case
+// their body is buffered so that it can be sent again.
+func (r *Retry) enabled(method string) bool {
+	return r != nil && r.Attempts > 1 && (idempotentMethods[method] || r.NonIdempotent)
+}
+
+// tryTimeout bounds a try to the perTryTimeout of the retry policy until its
+// response headers arrive, so that the body is streamed without a deadline.
+type tryTimeout struct {
+	timer   *time.Timer
+	mu      sync.Mutex
+	stopped bool
+	expired bool
+}
+
+// withTimeout returns req bound to the perTryTimeout of the retry policy, the
+// timeout to stop once the response headers arrived and the function
+// releasing the context of the try.
+func (r *Retry) withTimeout(req *http.Request) (*http.Request, *tryTimeout, context.CancelFunc) {
+	t := &tryTimeout{}
+	if r == nil || r.PerTryTimeout <= 0 {
+		return req, t, func() {}
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	t.timer = time.AfterFunc(time.Duration(r.PerTryTimeout)*time.Millisecond, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if !t.stopped {
+			t.expired = true
+			cancel()
+		}
+	})
+	return req.WithContext(ctx), t, cancel
+}
+
+// stop stops the timer of the try and reports whether it expired first.
+func (t *tryTimeout) stop() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	return t.expired
+}
+
+// retryable reports whether the outcome of a try is one that retryOn lists.
+func (r *Retry) retryable(timedOut bool, resp *http.Response, err error) bool {
+	retryOn := r.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = defaultRetryOn
+	}
+	var reason string
+	var opErr *net.OpError
+	switch {
+	case err == nil:
+		reason = strconv.Itoa(resp.StatusCode)
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		reason = retryOnConnectFailure
+	case timedOut:
+		reason = retryOnTimeout
+	default:
+		return false
+	}
+	for _, value := range retryOn {
+		if value == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// wait sleeps before the given retry, with a backoff that doubles on every
+// retry and full jitter. It returns false when ctx is done first.
+func (r *Retry) wait(ctx context.Context, retry int) bool {
+	backoff := milliseconds(r.Backoff, 25*time.Millisecond)
+	maxBackoff := milliseconds(r.MaxBackoff, 250*time.Millisecond)
+	for i := 1; i < retry && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff) + 1)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// retryBudgetWindow is the period over which requests and retries are
+// counted against the retry budget.
+const retryBudgetWindow = 10 * time.Second
+
+type retryBudget struct {
+	percent    int
+	minRetries int
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+// getRetryBudget returns the retry budget shared by every route of the
+// configuration: 20% of the requests plus 3 retries per second by default.
+func (conf *Configuration) getRetryBudget() *retryBudget {
+	if conf.retryBudget == nil {
+		conf.retryBudget = &retryBudget{percent: 20, minRetries: 3 * int(retryBudgetWindow/time.Second)}
+		if conf.RetryBudget != nil {
+			conf.retryBudget.percent = conf.RetryBudget.Percent
+			conf.retryBudget.minRetries = conf.RetryBudget.MinRetriesPerSecond * int(retryBudgetWindow/time.Second)
+		}
+	}
+	return conf.retryBudget
+}
+
+func (b *retryBudget) roll() {
+	if now := time.Now(); now.Sub(b.windowStart) > retryBudgetWindow {
+		b.windowStart = now
+		b.requests, b.retries = 0, 0
+	}
+}
+
+// request counts a request against the budget.
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	b.requests++
+}
+
+// withdraw reports whether the budget allows one more retry and counts it.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	if b.retries >= b.minRetries+b.requests*b.percent/100 {
+		return false
+	}
+	b.retries++
+	return true
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func retryEngine(conf *Configuration, route Route) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	for _, method := range route.AllowedMethods {
+		r.Handle(method, route.Path, route.GetCoreHandler(conf, method, nil))
+	}
+	return r
+}
+
+func TestRetry(t *testing.T) {
+	var failed int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failed, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer healthy.Close()
+
+	for _, test := range []struct {
+		method        string
+		nonIdempotent bool
+		status        int
+	}{
+		{http.MethodPut, false, http.StatusOK},
+		{http.MethodPost, false, http.StatusServiceUnavailable},
+		{http.MethodPost, true, http.StatusOK},
+	} {
+		conf := &Configuration{
+			Upstreams: map[string]*Upstream{
+				"test": {Hosts: []UpstreamHost{{Url: failing.URL}, {Url: healthy.URL}}},
+			},
+		}
+		route := Route{
+			Path:           "/",
+			ForwardUrl:     "test:/",
+			AllowedMethods: []string{test.method},
+			Retry:          &Retry{Attempts: 2, Backoff: 1, NonIdempotent: test.nonIdempotent},
+		}
+		w := httptest.NewRecorder()
+		retryEngine(conf, route).ServeHTTP(w, httptest.NewRequest(test.method, "/", strings.NewReader("payload")))
+		if w.Code != test.status {
+			t.Errorf("%s (nonIdempotent %t): expected status %d, got %d", test.method, test.nonIdempotent, test.status, w.Code)
+		}
+		if w.Code == http.StatusOK && w.Body.String() != "payload" {
+			t.Errorf("the body must be sent again on retry, got %q", w.Body.String())
+		}
+		conf.Close()
+	}
+	if atomic.LoadInt32(&failed) != 3 {
+		t.Errorf("every request must reach the first host once, got %d", failed)
+	}
+}
+
+func TestRetryConnectFailureAndTimeout(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer healthy.Close()
+
+	conf := &Configuration{
+		Upstreams: map[string]*Upstream{
+			"test": {Hosts: []UpstreamHost{{Url: closed.URL}, {Url: slow.URL}, {Url: healthy.URL}}},
+		},
+	}
+	defer conf.Close()
+	route := Route{
+		Path:           "/",
+		ForwardUrl:     "test:/",
+		AllowedMethods: []string{http.MethodGet},
+		Retry:          &Retry{Attempts: 3, PerTryTimeout: 50, RetryOn: []string{"connect-failure", "timeout"}, Backoff: 1},
+	}
+	w := httptest.NewRecorder()
+	retryEngine(conf, route).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("connection failures and timeouts must be retried on the next host, got %d", w.Code)
+	}
+}
+
+func TestPerTryTimeoutStreamedBody(t *testing.T) {
+	streaming := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("chunk\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer streaming.Close()
+	conf := &Configuration{
+		Upstreams: map[string]*Upstream{
+			"test": {Hosts: []UpstreamHost{{Url: streaming.URL}}},
+		},
+	}
+	defer conf.Close()
+	route := Route{Path: "/", ForwardUrl: "test:/", AllowedMethods: []string{http.MethodGet}, Retry: &Retry{Attempts: 2, PerTryTimeout: 250}}
+	proxy := httptest.NewServer(retryEngine(conf, route))
+	defer proxy.Close()
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != strings.Repeat("chunk\n", 5) {
+		t.Errorf("perTryTimeout must not cut a body streamed after the headers, got %q %v", body, err)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var requests int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	conf := &Configuration{
+		Upstreams: map[string]*Upstream{
+			"test": {Hosts: []UpstreamHost{{Url: failing.URL}}},
+		},
+		RetryBudget: &RetryBudget{Percent: 50, MinRetriesPerSecond: 0},
+	}
+	defer conf.Close()
+	route := Route{Path: "/", ForwardUrl: "test:/", AllowedMethods: []string{http.MethodGet}, Retry: &Retry{Attempts: 3, Backoff: 1}}
+	r := retryEngine(conf, route)
+	for i := 0; i < 4; i++ {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	if atomic.LoadInt32(&requests) != 6 {
+		t.Errorf("retries must stop at half of the requests, got %d tries for 4 requests", requests)
+	}
+}
+
+func TestValidateRetry(t *testing.T) {
+	conf := Configuration{
+		RetryBudget: &RetryBudget{Percent: 120},
+		Routes: []Route{{
+			Path:           "/",
+			ForwardUrl:     "http://localhost:8080/",
+			AllowedMethods: []string{"GET"},
+			Retry:          &Retry{Attempts: -1, RetryOn: []string{"500"}},
+		}},
+	}
+	err := conf.Validate()
+	for _, expected := range []string{"percent must be between 0 and 100", "attempts must not be negative", "routes[0].retry.retryOn[0]: retryOn must be connect-failure, timeout, 502, 503 or 504"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q, got %v", expected, err)
+		}
+	}
+}
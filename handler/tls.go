@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (t *UpstreamTLS) validate(conf *Configuration, path string) Errors {
+	var errs Errors
+	if _, ok := tlsVersions[t.MinVersion]; t.MinVersion != "" && !ok {
+		errs = append(errs, conf.fieldError(path+".minVersion", "unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", t.MinVersion))
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, conf.fieldError(path, "certFile and keyFile must be set together"))
+	} else if t.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile); err != nil {
+			errs = append(errs, conf.fieldError(path+".certFile", err.Error()))
+		}
+	}
+	if t.CaFile != "" {
+		if _, err := loadCertPool(t.CaFile); err != nil {
+			errs = append(errs, conf.fieldError(path+".caFile", err.Error()))
+		}
+	}
+	if t.InsecureSkipVerify {
+		log.Printf("WARNING: %s.insecureSkipVerify disables verification of upstream certificates.", path)
+	}
+	return errs
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s contains no PEM certificates", caFile)
+	}
+	return pool, nil
+}
+
+// fileReloader caches a value loaded from files and loads it again once any
+// of the files has been modified on disk, so rotated certificates are picked
+// up without a restart. If a reload fails the previous value is kept.
+type fileReloader struct {
+	files   []string
+	load    func() (interface{}, error)
+	mu      sync.Mutex
+	value   interface{}
+	modTime time.Time
+}
+
+func (r *fileReloader) get() (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var modTime time.Time
+	for _, file := range r.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			if r.value != nil {
+				return r.value, nil
+			}
+			return nil, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if r.value != nil && !modTime.After(r.modTime) {
+		return r.value, nil
+	}
+	value, err := r.load()
+	if err != nil {
+		if r.value != nil {
+			log.Printf("WARNING: reloading %v failed, keeping the previous certificate: %s", r.files, err)
+			return r.value, nil
+		}
+		return nil, err
+	}
+	r.value, r.modTime = value, modTime
+	return value, nil
+}
+
+// getConfig builds the client TLS configuration of an upstream. Client
+// certificates and the CA bundle are read on handshake and reloaded when the
+// files change.
+func (t *UpstreamTLS) getConfig() *tls.Config {
+	config := &tls.Config{
+		ServerName:         t.ServerName,
+		MinVersion:         tlsVersions[t.MinVersion],
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CertFile != "" && t.KeyFile != "" {
+		keyPair := &fileReloader{
+			files: []string{t.CertFile, t.KeyFile},
+			load: func() (interface{}, error) {
+				certificate, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+				return &certificate, err
+			},
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certificate, err := keyPair.get()
+			if err != nil {
+				return nil, err
+			}
+			return certificate.(*tls.Certificate), nil
+		}
+	}
+	if t.verifiesCA() {
+		t.roots = &fileReloader{
+			files: []string{t.CaFile},
+			load: func() (interface{}, error) {
+				return loadCertPool(t.CaFile)
+			},
+		}
+		// The default verification is replaced by one against the current
+		// CA bundle, so the bundle can be rotated on disk.
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = t.verifyConnection(t.ServerName)
+	}
+	return config
+}
+
+// verifiesCA reports whether the certificates of the upstream are verified
+// against caFile rather than the system roots.
+func (t *UpstreamTLS) verifiesCA() bool {
+	return t.CaFile != "" && !t.InsecureSkipVerify
+}
+
+// configFor returns the configuration of a connection to host. The server
+// name defaults to host, and with a caFile the certificate is verified
+// against the server name, so that an upstream reached by IP address, for
+// which no SNI is sent, is verified against that address.
+func (t *UpstreamTLS) configFor(config *tls.Config, host string) *tls.Config {
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	if t.verifiesCA() {
+		config.VerifyConnection = t.verifyConnection(config.ServerName)
+	}
+	return config
+}
+
+func (t *UpstreamTLS) verifyConnection(name string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if name == "" {
+			return errors.New("no server name to verify the upstream certificate against")
+		}
+		pool, err := t.roots.get()
+		if err != nil {
+			return err
+		}
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("upstream presented no certificate")
+		}
+		opts := x509.VerifyOptions{
+			DNSName:       name,
+			Roots:         pool.(*x509.CertPool),
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, certificate := range state.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(certificate)
+		}
+		_, err = state.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
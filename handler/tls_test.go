@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePEM(t *testing.T, location string, blockType string, der []byte) {
+	if err := ioutil.WriteFile(location, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeClientCertificate(t *testing.T, certFile string, keyFile string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	var clientName string
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientName = r.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+	writePEM(t, caFile, "CERTIFICATE", upstream.Certificate().Raw)
+	writeClientCertificate(t, certFile, keyFile, "first")
+
+	conf := &Configuration{
+		Upstreams: map[string]*Upstream{
+			"secure": {
+				Hosts: []UpstreamHost{{Url: upstream.URL}},
+				TLS: &UpstreamTLS{
+					CaFile:     caFile,
+					CertFile:   certFile,
+					KeyFile:    keyFile,
+					ServerName: "example.com",
+					MinVersion: "1.2",
+				},
+			},
+		},
+	}
+	if errs := conf.Upstreams["secure"].validate(conf, "upstreams.secure"); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	route := Route{ForwardUrl: "secure:/"}
+	client := conf.getClient(route)
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if clientName != "first" {
+		t.Errorf("expected client certificate first, got %s", clientName)
+	}
+
+	// A rotated client certificate is used for new connections.
+	writeClientCertificate(t, certFile, keyFile, "second")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	client.Transport.(*http.Transport).CloseIdleConnections()
+	resp, err = client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if clientName != "second" {
+		t.Errorf("expected rotated client certificate second, got %s", clientName)
+	}
+}
+
+func TestUpstreamTLSUnknownCA(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "other CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	writePEM(t, caFile, "CERTIFICATE", der)
+
+	conf := &Configuration{
+		Upstreams: map[string]*Upstream{
+			"secure": {Hosts: []UpstreamHost{{Url: upstream.URL}}, TLS: &UpstreamTLS{CaFile: caFile}},
+		},
+	}
+	if _, err := conf.getClient(Route{ForwardUrl: "secure:/"}).Get(upstream.URL); err == nil {
+		t.Error("a certificate not signed by caFile must be rejected")
+	}
+}
+
+func TestUpstreamTLSHostMismatch(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "private CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	ca, _ := x509.ParseCertificate(caDer)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "other.example"},
+		DNSNames:     []string{"other.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", caDer)
+	get := func(serverName string) error {
+		conf := &Configuration{
+			Upstreams: map[string]*Upstream{
+				"secure": {Hosts: []UpstreamHost{{Url: upstream.URL}}, TLS: &UpstreamTLS{CaFile: caFile, ServerName: serverName}},
+			},
+		}
+		resp, err := conf.getClient(Route{ForwardUrl: "secure:/"}).Get(upstream.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	if err := get(""); err == nil {
+		t.Error("a certificate not issued for the IP address dialed must be rejected")
+	}
+	if err := get("other.example"); err != nil {
+		t.Errorf("a certificate issued for serverName must be accepted, got %v", err)
+	}
+	conf := &Configuration{
+		Upstreams: map[string]*Upstream{
+			"secure": {Hosts: []UpstreamHost{{Url: upstream.URL}}, TLS: &UpstreamTLS{CaFile: caFile}},
+		},
+	}
+	u, _ := url.Parse(upstream.URL)
+	if conn, err := dialUpstream(u, conf.getTLSConfig(Route{ForwardUrl: "secure:/"})); err == nil {
+		conn.Close()
+		t.Error("upgraded connections must verify the certificate against the IP address dialed")
+	}
+}
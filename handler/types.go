@@ -1,5 +1,11 @@
 package handler
 
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
 type CorsConfig struct {
 	Origin         string `json:"origin"`
 	Methods        string `json:"methods"`
@@ -11,38 +17,224 @@ type CorsConfig struct {
 }
 
 type Route struct {
-	Path           string            `json:"path"`
-	ForwardUrl     string            `json:"forwardUrl"`
-	AllowedMethods []string          `json:"allowedMethods"`
-	ForwardIp      bool              `json:"forwardIp"`
-	AppendPath     bool              `json:"appendPath"`
-	CustomHeaders  map[string]string `json:"customHeaders"`
-	SecureHeaders  bool              `json:"secureHeaders"`
-	Cors           CorsConfig        `json:"cors"`
-	Cache          int               `json:"cache"`
-	Timeout        int               `json:"timeout"`
+	Path             string            `json:"path"`
+	ForwardUrl       string            `json:"forwardUrl"`
+	AllowedMethods   []string          `json:"allowedMethods"`
+	ForwardIp        bool              `json:"forwardIp"`
+	ForwardedHeaders string            `json:"forwardedHeaders"`
+	AppendPath       bool              `json:"appendPath"`
+	CustomHeaders    map[string]string `json:"customHeaders"`
+	SecureHeaders    bool              `json:"secureHeaders"`
+	Cors             CorsConfig        `json:"cors"`
+	Cache            int               `json:"cache"`
+	Timeout          int               `json:"timeout"`
+	MaxBodySize      int64             `json:"maxBodySize"`
+	IdleTimeout      int               `json:"idleTimeout"`
+	Retry            *Retry            `json:"retry"`
+	Access           []AccessRule      `json:"access"`
+	Discovery        *DiscoveryFilter  `json:"discovery"`
+}
+
+// DiscoveryFilter restricts a route forwarding to a discovered service to the
+// instances of a version carrying every tag and metadata entry listed. The
+// instances of zone are preferred while any of them is available.
+type DiscoveryFilter struct {
+	Version  string            `json:"version"`
+	Tags     []string          `json:"tags"`
+	Metadata map[string]string `json:"metadata"`
+	Zone     string            `json:"zone"`
+}
+
+// AccessRule allows or denies the clients whose IP is in a range: an IP
+// address, a CIDR range or "all". Rules are checked in order and the first
+// one that matches the client decides.
+type AccessRule struct {
+	Allow string `json:"allow"`
+	Deny  string `json:"deny"`
+}
+
+// Retry retries a failed request on another host of the upstream. A try is
+// retried on the failures listed in retryOn: connect-failure, timeout (the
+// perTryTimeout expired), 502, 503 or 504. Requests with a non-idempotent
+// method are only retried with nonIdempotent. Times are in milliseconds and
+// the backoff between tries grows from backoff to maxBackoff with jitter.
+type Retry struct {
+	Attempts      int      `json:"attempts"`
+	PerTryTimeout int      `json:"perTryTimeout"`
+	RetryOn       []string `json:"retryOn"`
+	Backoff       int      `json:"backoff"`
+	MaxBackoff    int      `json:"maxBackoff"`
+	NonIdempotent bool     `json:"nonIdempotent"`
+}
+
+// RetryBudget caps the retries of every route together to percent of the
+// requests plus minRetriesPerSecond, so that retries can not snowball when
+// the upstreams are overloaded.
+type RetryBudget struct {
+	Percent             int `json:"percent"`
+	MinRetriesPerSecond int `json:"minRetriesPerSecond"`
 }
 
 type Configuration struct {
-	Listen      string              `json:"listen"`
-	Certificate string              `json:"certificate"`
-	Key         string              `json:"key"`
-	Log         string              `json:"log"`
-	WhiteList   []string            `json:"whiteList"`
-	Compression bool                `json:"compression"`
-	Upstreams   map[string][]string `json:"upstreams"`
-	Routes      []Route             `json:"routes"`
-	Discovery   bool                `json:"discovery"`
+	Include              []string             `json:"include"`
+	Listen               string               `json:"listen"`
+	Certificate          string               `json:"certificate"`
+	Key                  string               `json:"key"`
+	Log                  string               `json:"log"`
+	WhiteList            []string             `json:"whiteList"`
+	Access               []AccessRule         `json:"access"`
+	TrustedProxies       []string             `json:"trustedProxies"`
+	ClientIpHeader       string               `json:"clientIpHeader"`
+	ProxyProtocol        bool                 `json:"proxyProtocol"`
+	Compression          bool                 `json:"compression"`
+	Upstreams            map[string]*Upstream `json:"upstreams"`
+	Routes               []Route              `json:"routes"`
+	Discovery            bool                 `json:"discovery"`
+	DiscoveryHealthCheck *HealthCheck         `json:"discoveryHealthCheck"`
+	DiscoveryAuth        *DiscoveryAuth       `json:"discoveryAuth"`
+	ShutdownTimeout      int                  `json:"shutdownTimeout"`
+	RetryBudget          *RetryBudget         `json:"retryBudget"`
+	Locations            Locations            `json:"-"`
+
+	retryBudget *retryBudget
 }
 
+// Upstream is a named group of hosts. It is configured either as a list of
+// hosts or as an object carrying the hosts, the load balancing strategy and
+// the settings of the HTTP transport shared by every route forwarding to it.
+// With discovery enabled, an upstream without hosts configures the service of
+// the same name registered through the discovery endpoint. Timeouts are in
+// milliseconds.
+type Upstream struct {
+	Hosts                 []UpstreamHost  `json:"hosts"`
+	LoadBalancing         string          `json:"loadBalancing"`
+	HashOn                string          `json:"hashOn"`
+	MaxIdleConns          int             `json:"maxIdleConns"`
+	MaxIdleConnsPerHost   int             `json:"maxIdleConnsPerHost"`
+	MaxConnsPerHost       int             `json:"maxConnsPerHost"`
+	IdleConnTimeout       int             `json:"idleConnTimeout"`
+	DialTimeout           int             `json:"dialTimeout"`
+	KeepAlive             int             `json:"keepAlive"`
+	TLSHandshakeTimeout   int             `json:"tlsHandshakeTimeout"`
+	ResponseHeaderTimeout int             `json:"responseHeaderTimeout"`
+	TLS                   *UpstreamTLS    `json:"tls"`
+	HealthCheck           *HealthCheck    `json:"healthCheck"`
+	CircuitBreaker        *CircuitBreaker `json:"circuitBreaker"`
+
+	transport     *http.Transport
+	transportOnce sync.Once
+	balancer      *loadBalancer
+	balancerOnce  sync.Once
+	stop          chan struct{}
+	stopOnce      sync.Once
+}
+
+// UpstreamHost is a host of an upstream, written either as its URL or as an
+// object with the URL and a weight (1 by default) for the weighted
+// strategies.
+type UpstreamHost struct {
+	Url    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// UpstreamTLS configures how goginx connects to the hosts of an upstream over
+// HTTPS: a private CA bundle, a client certificate for mutual TLS, the SNI
+// server name and the minimum TLS version ("1.0" to "1.3").
+type UpstreamTLS struct {
+	CaFile             string `json:"caFile"`
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	ServerName         string `json:"serverName"`
+	MinVersion         string `json:"minVersion"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+
+	roots *fileReloader
+}
+
+// HealthCheck actively probes every host of an upstream with a GET request
+// on path. A host is taken out of rotation after unhealthyThreshold failed
+// checks in a row and put back after healthyThreshold successful ones. A
+// check succeeds when the status is within expectedStatus, a code or a range
+// such as "200-399". Interval and timeout are in milliseconds.
+type HealthCheck struct {
+	Path               string `json:"path"`
+	Interval           int    `json:"interval"`
+	Timeout            int    `json:"timeout"`
+	ExpectedStatus     string `json:"expectedStatus"`
+	HealthyThreshold   int    `json:"healthyThreshold"`
+	UnhealthyThreshold int    `json:"unhealthyThreshold"`
+}
+
+// CircuitBreaker ejects a host of an upstream after consecutiveFailures
+// failed requests in a row (5xx responses or connection errors), or once
+// errorRate percent of at least minRequests requests within window failed.
+// An ejected host gets no traffic for ejectionTime, doubled on every
+// ejection in a row up to maxEjectionTime, and then receives a single probe
+// request that closes the breaker on success. Times are in milliseconds.
+type CircuitBreaker struct {
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	ErrorRate           int `json:"errorRate"`
+	MinRequests         int `json:"minRequests"`
+	Window              int `json:"window"`
+	EjectionTime        int `json:"ejectionTime"`
+	MaxEjectionTime     int `json:"maxEjectionTime"`
+}
+
+// Locations maps the JSON path of every field read from a configuration
+// file (e.g. routes[0].forwardUrl) to its file:line:column.
+type Locations map[string]string
+
+// DiscoveryClient is an instance of a service registered through the
+// discovery endpoint. Its registration is a lease of ttl seconds (30 by
+// default) that the instance renews by registering again. Routes select
+// instances by version, tags, zone and metadata, and the weight (1 by
+// default) is used by the weighted balancing strategies. The instance is
+// health checked with a GET request on healthCheckPath, or by connecting to
+// it when there is no path.
 type DiscoveryClient struct {
-	Service string `json:"service"`
-	Host    string `json:"host"`
-	Port    int    `json:"port"`
-	Active  bool
+	Service         string            `json:"service"`
+	Host            string            `json:"host"`
+	Port            int               `json:"port"`
+	Ttl             int               `json:"ttl"`
+	Tags            []string          `json:"tags"`
+	Weight          int               `json:"weight"`
+	Version         string            `json:"version"`
+	Zone            string            `json:"zone"`
+	Metadata        map[string]string `json:"metadata"`
+	HealthCheckPath string            `json:"healthCheckPath"`
+	Active          bool              `json:"active"`
+	LastHeartbeat   time.Time         `json:"lastHeartbeat"`
+}
+
+// DiscoveryAuth requires the registrations and deregistrations of instances
+// to present one of the credentials: a bearer token, an HMAC-SHA256 signature
+// made with a shared secret, or a client certificate issued by clientCa with
+// the given common name. Signatures older than maxClockSkew milliseconds (5
+// minutes by default) are refused.
+type DiscoveryAuth struct {
+	Credentials  []DiscoveryCredential `json:"credentials"`
+	ClientCa     string                `json:"clientCa"`
+	MaxClockSkew int                   `json:"maxClockSkew"`
+}
+
+// DiscoveryCredential is a credential allowed to register the services
+// matching one of the patterns of services, such as "payments" or "billing-*".
+type DiscoveryCredential struct {
+	Name       string   `json:"name"`
+	Token      string   `json:"token"`
+	HmacSecret string   `json:"hmacSecret"`
+	CommonName string   `json:"commonName"`
+	Services   []string `json:"services"`
 }
 
+// DiscoveryService is the registry of the instances registered through the
+// discovery endpoint. It is safe for concurrent use.
 type DiscoveryService struct {
-	services            map[string][]DiscoveryClient
-	serviceCurrentIndex map[string]int
+	mu          sync.RWMutex
+	services    map[string][]*DiscoveryClient
+	healthCheck *HealthCheck
+	revision    uint64
+	changed     chan struct{}
+	stop        chan struct{}
+	stopOnce    sync.Once
 }
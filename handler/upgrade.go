@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultIdleTimeout = 60 * time.Second
+	upgradeDialTimeout = 10 * time.Second
+)
+
+// tunnels holds the client connections hijacked by upgraded requests, which
+// the HTTP server no longer waits for or closes on shutdown.
+var tunnels = &tunnelRegistry{conns: make(map[net.Conn]struct{})}
+
+type tunnelRegistry struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	idle  chan struct{}
+}
+
+func (r *tunnelRegistry) add(conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.conns) == 0 {
+		r.idle = make(chan struct{})
+	}
+	r.conns[conn] = struct{}{}
+}
+
+func (r *tunnelRegistry) remove(conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, conn)
+	if len(r.conns) == 0 {
+		close(r.idle)
+	}
+}
+
+// CloseTunnels waits for the upgraded connections to end until ctx is done
+// and then closes the remaining ones.
+func CloseTunnels(ctx context.Context) {
+	for {
+		tunnels.mu.Lock()
+		if len(tunnels.conns) == 0 {
+			tunnels.mu.Unlock()
+			return
+		}
+		idle := tunnels.idle
+		tunnels.mu.Unlock()
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			tunnels.mu.Lock()
+			for conn := range tunnels.conns {
+				conn.Close()
+			}
+			tunnels.mu.Unlock()
+			return
+		}
+	}
+}
+
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func dialUpstream(u *url.URL, tlsConfig func(host string) *tls.Config) (net.Conn, error) {
+	host := u.Host
+	dialer := &net.Dialer{Timeout: upgradeDialTimeout}
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+		config := &tls.Config{ServerName: u.Hostname()}
+		if tlsConfig != nil {
+			config = tlsConfig(u.Hostname())
+		}
+		return tls.DialWithDialer(dialer, "tcp", host, config)
+	}
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	return dialer.Dial("tcp", host)
+}
+
+// idleTunnel holds the connections of a tunnel, whose deadlines are extended
+// together so that traffic in either direction keeps the whole tunnel open.
+type idleTunnel struct {
+	idleTimeout time.Duration
+	conns       []net.Conn
+}
+
+func (t *idleTunnel) extend() {
+	deadline := time.Now().Add(t.idleTimeout)
+	for _, conn := range t.conns {
+		conn.SetDeadline(deadline)
+	}
+}
+
+// idleConn extends the deadlines of its tunnel on every read and write so that
+// a piped connection is closed only after idleTimeout without traffic.
+type idleConn struct {
+	net.Conn
+	tunnel *idleTunnel
+}
+
+func (c idleConn) Read(p []byte) (int, error) {
+	c.tunnel.extend()
+	return c.Conn.Read(p)
+}
+
+func (c idleConn) Write(p []byte) (int, error) {
+	c.tunnel.extend()
+	return c.Conn.Write(p)
+}
+
+// proxyUpgrade forwards an HTTP Upgrade request (e.g. WebSocket) to the
+// upstream. If the upstream switches protocols the client connection is
+// hijacked and bytes are piped in both directions until either side closes
+// or the connection is idle for longer than the route idleTimeout.
+func (route Route) proxyUpgrade(c *gin.Context, proxyReq *http.Request, tlsConfig func(host string) *tls.Config) error {
+	idleTimeout := defaultIdleTimeout
+	if route.IdleTimeout > 0 {
+		idleTimeout = time.Duration(route.IdleTimeout) * time.Millisecond
+	}
+	upstreamConn, err := dialUpstream(proxyReq.URL, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer upstreamConn.Close()
+	tunnel := &idleTunnel{idleTimeout: idleTimeout, conns: []net.Conn{upstreamConn}}
+	upstream := idleConn{upstreamConn, tunnel}
+	if err := proxyReq.Write(upstream); err != nil {
+		return err
+	}
+	upstreamReader := bufio.NewReader(upstream)
+	resp, err := http.ReadResponse(upstreamReader, proxyReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		forwardResponseHeader(c.Writer.Header(), resp)
+		c.Status(resp.StatusCode)
+		io.Copy(c.Writer, resp.Body)
+		return nil
+	}
+
+	clientConn, clientBuf, err := c.Writer.Hijack()
+	if err != nil {
+		return err
+	}
+	defer clientConn.Close()
+	tunnels.add(clientConn)
+	defer tunnels.remove(clientConn)
+	tunnel.conns = append(tunnel.conns, clientConn)
+	client := idleConn{clientConn, tunnel}
+	// The bytes the server read ahead are forwarded before the connection.
+	buffered, _ := clientBuf.Reader.Peek(clientBuf.Reader.Buffered())
+	clientReader := io.MultiReader(bytes.NewReader(buffered), client)
+	if _, err := fmt.Fprintf(client, "HTTP/1.1 %s\r\n", resp.Status); err != nil {
+		return nil
+	}
+	if err := resp.Header.Write(client); err != nil {
+		return nil
+	}
+	if _, err := io.WriteString(client, "\r\n"); err != nil {
+		return nil
+	}
+
+	incMetric(metricUpgradeConnectionsTotal, route.Path)
+	addMetric(metricUpgradeConnections, 1, route.Path)
+	defer addMetric(metricUpgradeConnections, -1, route.Path)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, clientReader)
+		upstreamConn.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(client, upstreamReader)
+		clientConn.Close()
+	}()
+	wg.Wait()
+	return nil
+}
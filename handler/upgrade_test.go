@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestProxyUpgrade(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgradeRequest(r) {
+			t.Error("upgrade headers were not forwarded")
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	}))
+	defer upstream.Close()
+
+	gin.SetMode(gin.TestMode)
+	conf := &Configuration{
+		Routes: []Route{
+			{
+				Path:           "/ws",
+				ForwardUrl:     upstream.URL,
+				AllowedMethods: []string{"GET"},
+			},
+		},
+	}
+	r := gin.New()
+	r.GET("/ws", conf.Routes[0].GetCoreHandler(conf, "GET", nil))
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: goginx\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	io.WriteString(conn, "ping\n")
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "ping\n" {
+		t.Errorf("expected echoed ping, got %q", line)
+	}
+}
+
+func TestCloseTunnels(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	}))
+	defer upstream.Close()
+
+	gin.SetMode(gin.TestMode)
+	conf := &Configuration{
+		Routes: []Route{
+			{
+				Path:           "/ws",
+				ForwardUrl:     upstream.URL,
+				AllowedMethods: []string{"GET"},
+			},
+		},
+	}
+	r := gin.New()
+	r.GET("/ws", conf.Routes[0].GetCoreHandler(conf, "GET", nil))
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: goginx\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	CloseTunnels(ctx)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("open tunnels must be drained until the deadline, returned after %v", elapsed)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected the tunnel to be closed, got %v", err)
+	}
+	CloseTunnels(context.Background())
+}
+
+func TestProxyUpgradeOneWayStream(t *testing.T) {
+	received := make(chan int, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: stream\r\n\r\n")
+		buf.Flush()
+		n, _ := io.Copy(ioutil.Discard, buf)
+		received <- int(n)
+	}))
+	defer upstream.Close()
+
+	gin.SetMode(gin.TestMode)
+	conf := &Configuration{
+		Routes: []Route{
+			{
+				Path:           "/ws",
+				ForwardUrl:     upstream.URL,
+				AllowedMethods: []string{"GET"},
+				IdleTimeout:    300,
+			},
+		},
+	}
+	r := gin.New()
+	r.GET("/ws", conf.Routes[0].GetCoreHandler(conf, "GET", nil))
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: goginx\r\nConnection: Upgrade\r\nUpgrade: stream\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	sent := 0
+	for start := time.Now(); time.Since(start) < time.Second; sent++ {
+		if _, err := conn.Write([]byte{'x'}); err != nil {
+			t.Fatalf("a stream outliving idleTimeout must stay open, write %d failed: %v", sent+1, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	conn.Close()
+	select {
+	case n := <-received:
+		if n != sent {
+			t.Errorf("expected %d bytes upstream, got %d", sent, n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the client must close the tunnel")
+	}
+}
@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func (u *Upstream) UnmarshalJSON(data []byte) error {
+	var hosts []UpstreamHost
+	if err := json.Unmarshal(data, &hosts); err == nil {
+		u.Hosts = hosts
+		return nil
+	}
+	type upstream Upstream
+	return json.Unmarshal(data, (*upstream)(u))
+}
+
+func (u *Upstream) validate(conf *Configuration, path string) Errors {
+	var errs Errors
+	if len(u.Hosts) == 0 && !conf.Discovery {
+		errs = append(errs, conf.fieldError(path, "upstream must have atleast one host"))
+	}
+	if _, ok := loadBalancingStrategies[u.LoadBalancing]; !ok {
+		errs = append(errs, conf.fieldError(path+".loadBalancing", "unknown load balancing strategy %q", u.LoadBalancing))
+	}
+	if u.HashOn != "" {
+		if !validHashOn(u.HashOn) {
+			errs = append(errs, conf.fieldError(path+".hashOn", "hashOn must be ip, header:<name> or cookie:<name>"))
+		}
+		if u.LoadBalancing != "" {
+			errs = append(errs, conf.fieldError(path+".loadBalancing", "loadBalancing can not be combined with hashOn"))
+		}
+	}
+	for i, host := range u.Hosts {
+		hostPath := fmt.Sprintf("%s.hosts[%d]", path, i)
+		if host.Url == "" {
+			errs = append(errs, conf.fieldError(hostPath, "host url must not be empty"))
+		}
+		if host.Weight < 0 {
+			errs = append(errs, conf.fieldError(hostPath+".weight", "weight must not be negative"))
+		}
+	}
+	errs = append(errs, conf.nonNegative(path,
+		setting{"maxIdleConns", u.MaxIdleConns},
+		setting{"maxIdleConnsPerHost", u.MaxIdleConnsPerHost},
+		setting{"maxConnsPerHost", u.MaxConnsPerHost},
+		setting{"idleConnTimeout", u.IdleConnTimeout},
+		setting{"dialTimeout", u.DialTimeout},
+		setting{"keepAlive", u.KeepAlive},
+		setting{"tlsHandshakeTimeout", u.TLSHandshakeTimeout},
+		setting{"responseHeaderTimeout", u.ResponseHeaderTimeout},
+	)...)
+	if u.TLS != nil {
+		errs = append(errs, u.TLS.validate(conf, path+".tls")...)
+	}
+	if u.HealthCheck != nil {
+		errs = append(errs, u.HealthCheck.validate(conf, path+".healthCheck")...)
+	}
+	if u.CircuitBreaker != nil {
+		errs = append(errs, u.CircuitBreaker.validate(conf, path+".circuitBreaker")...)
+	}
+	return errs
+}
+
+func sortedUpstreamNames(upstreams map[string]*Upstream) []string {
+	names := make([]string, 0, len(upstreams))
+	for name := range upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func milliseconds(value int, fallback time.Duration) time.Duration {
+	if value > 0 {
+		return time.Duration(value) * time.Millisecond
+	}
+	return fallback
+}
+
+// getTransport returns the transport shared by every route that forwards to
+// the upstream, creating it on first use.
+func (u *Upstream) getTransport(name string) *http.Transport {
+	u.transportOnce.Do(func() {
+		dialer := &net.Dialer{
+			Timeout:   milliseconds(u.DialTimeout, 30*time.Second),
+			KeepAlive: milliseconds(u.KeepAlive, 30*time.Second),
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		dial := func(ctx context.Context, network string, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			incMetric(metricUpstreamConnectionsTotal, name)
+			addMetric(metricUpstreamConnectionsOpen, 1, name)
+			return &countedConn{Conn: conn, upstream: name}, nil
+		}
+		transport.DialContext = dial
+		transport.MaxIdleConns = 100
+		if u.MaxIdleConns > 0 {
+			transport.MaxIdleConns = u.MaxIdleConns
+		}
+		transport.MaxIdleConnsPerHost = u.MaxIdleConnsPerHost
+		transport.MaxConnsPerHost = u.MaxConnsPerHost
+		transport.IdleConnTimeout = milliseconds(u.IdleConnTimeout, 90*time.Second)
+		transport.TLSHandshakeTimeout = milliseconds(u.TLSHandshakeTimeout, 10*time.Second)
+		transport.ResponseHeaderTimeout = milliseconds(u.ResponseHeaderTimeout, 0)
+		if u.TLS != nil {
+			transport.TLSClientConfig = u.TLS.getConfig()
+		}
+		if u.TLS != nil && u.TLS.verifiesCA() {
+			// The certificate is verified against the host dialed, which
+			// the TLS configuration of the transport does not know.
+			transport.DialTLSContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+				conn, err := dial(ctx, network, address)
+				if err != nil {
+					return nil, err
+				}
+				host, _, _ := net.SplitHostPort(address)
+				tlsConn := tls.Client(conn, u.TLS.configFor(transport.TLSClientConfig, host))
+				conn.SetDeadline(time.Now().Add(transport.TLSHandshakeTimeout))
+				if err := tlsConn.Handshake(); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				conn.SetDeadline(time.Time{})
+				return tlsConn, nil
+			}
+		}
+		u.transport = transport
+	})
+	return u.transport
+}
+
+// getBalancer returns the load balancer shared by every route that forwards to
+// the upstream, so that in-flight counts and weights span all of them, and
+// starts the health checks of its hosts.
+func (u *Upstream) getBalancer(name string) *loadBalancer {
+	u.balancerOnce.Do(func() {
+		hosts := make([]*upstreamHost, len(u.Hosts))
+		for i, host := range u.Hosts {
+			hosts[i] = &upstreamHost{url: host.Url, weight: host.Weight, breaker: newBreaker(u.CircuitBreaker, host.Url)}
+			if hosts[i].weight == 0 {
+				hosts[i].weight = 1
+			}
+		}
+		u.balancer = newLoadBalancer(hosts, u.LoadBalancing, u.HashOn)
+		u.balancer.circuitBreaker = u.CircuitBreaker
+		u.stop = make(chan struct{})
+		u.startHealthChecks(name, hosts)
+	})
+	return u.balancer
+}
+
+// countedConn keeps the open connections gauge of its upstream up to date.
+type countedConn struct {
+	net.Conn
+	upstream  string
+	closeOnce sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() {
+		addMetric(metricUpstreamConnectionsOpen, -1, c.upstream)
+	})
+	return c.Conn.Close()
+}
+
+// getClient returns the HTTP client for a route: the pooled transport of its
+// upstream, or the default client for routes forwarding to a plain URL.
+func (conf *Configuration) getClient(route Route) *http.Client {
+	upstream, ok := conf.Upstreams[route.forwardScheme()]
+	if !ok || upstream == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: upstream.getTransport(route.forwardScheme())}
+}
+
+// getTLSConfig returns the TLS configuration of a connection to a host of
+// the upstream of a route, or nil for the defaults.
+func (conf *Configuration) getTLSConfig(route Route) func(host string) *tls.Config {
+	upstream, ok := conf.Upstreams[route.forwardScheme()]
+	if !ok || upstream == nil || upstream.TLS == nil {
+		return nil
+	}
+	config := upstream.getTransport(route.forwardScheme()).TLSClientConfig
+	return func(host string) *tls.Config {
+		return upstream.TLS.configFor(config, host)
+	}
+}
+
+// traceConnectionReuse counts whether proxied requests to an upstream were
+// sent on a pooled connection or on a new one.
+func traceConnectionReuse(req *http.Request, upstream string) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			incMetric(metricUpstreamConnectionReuse, upstream, strconv.FormatBool(info.Reused))
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// Close stops the health checks and releases the idle connections of every
+// upstream. It is called once a configuration has been replaced or the server
+// shuts down.
+func (conf *Configuration) Close() {
+	for _, upstream := range conf.Upstreams {
+		if upstream == nil {
+			continue
+		}
+		upstream.stopHealthChecks()
+		if upstream.transport != nil {
+			upstream.transport.CloseIdleConnections()
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUpstreamDialTimeout(t *testing.T) {
+	// A listener with no backlog that never accepts holds the handshake of
+	// every connection after the first one.
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+	filler, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filler.Close()
+
+	upstream := &Upstream{Hosts: []UpstreamHost{{Url: "http://" + address}}, DialTimeout: 100}
+	defer (&Configuration{Upstreams: map[string]*Upstream{"blackhole": upstream}}).Close()
+	client := &http.Client{Transport: upstream.getTransport("blackhole")}
+	start := time.Now()
+	_, err = client.Get("http://" + address)
+	if netErr, ok := err.(interface{ Timeout() bool }); !ok || !netErr.Timeout() {
+		t.Errorf("dialTimeout must fail the connection, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dialTimeout must bound the dial, took %v", elapsed)
+	}
+}
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/penglongli/gin-metrics/ginmetrics"
+)
+
+// metricsEngine serves the metrics of the monitor. The monitor is set up
+// before any test runs since the tests update metrics from their goroutines.
+var metricsEngine = func() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	m := ginmetrics.GetMonitor()
+	m.SetMetricPath("/metrics")
+	m.Use(r)
+	RegisterMetrics(m)
+	return r
+}()
+
+// readMetric returns the value of a sample served on /metrics by the monitor,
+// or 0 when it is not exposed.
+func readMetric(t *testing.T, sample string) float64 {
+	w := httptest.NewRecorder()
+	metricsEngine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, sample+" ") {
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, sample+" "), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return value
+		}
+	}
+	return 0
+}
+
+func TestUpstreamPoolSharedByRoutes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	conf := &Configuration{
+		Upstreams: map[string]*Upstream{
+			"pool": {Hosts: []UpstreamHost{{Url: upstream.URL}}},
+		},
+	}
+	defer conf.Close()
+	routes := []Route{
+		{Path: "/a", ForwardUrl: "pool:/", AllowedMethods: []string{http.MethodGet}},
+		{Path: "/b", ForwardUrl: "pool:/", AllowedMethods: []string{http.MethodGet}},
+	}
+	if conf.getClient(routes[0]).Transport != conf.getClient(routes[1]).Transport {
+		t.Error("routes forwarding to the same upstream must share its transport")
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	for _, route := range routes {
+		r.GET(route.Path, route.GetCoreHandler(conf, http.MethodGet, nil))
+	}
+	reused := `goginx_upstream_connection_reuse_total{reused="true",upstream="pool"}`
+	before := readMetric(t, reused)
+	for _, path := range []string{"/a", "/b"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s failed with %d", path, w.Code)
+		}
+	}
+	if after := readMetric(t, reused); after != before+1 {
+		t.Errorf("the second route must reuse the kept-alive connection of the first, reused went from %v to %v", before, after)
+	}
+}
+
+func TestUpstreamResponseHeaderTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer slow.Close()
+	upstream := &Upstream{Hosts: []UpstreamHost{{Url: slow.URL}}, ResponseHeaderTimeout: 50}
+	defer (&Configuration{Upstreams: map[string]*Upstream{"slow": upstream}}).Close()
+	client := &http.Client{Transport: upstream.getTransport("slow")}
+	start := time.Now()
+	if _, err := client.Get(slow.URL); err == nil || !strings.Contains(err.Error(), "timeout awaiting response headers") {
+		t.Errorf("responseHeaderTimeout must fail the request, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("responseHeaderTimeout must not wait for the response, took %v", elapsed)
+	}
+}
@@ -3,16 +3,14 @@ package handler
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
-	"strconv"
 	"strings"
-	"time"
+	"sync/atomic"
 
 	"github.com/gin-gonic/gin"
-	roundrobin "github.com/hlts2/round-robin"
 )
 
 func checkAndSendError(c *gin.Context, err error) bool {
@@ -24,6 +22,50 @@ func checkAndSendError(c *gin.Context, err error) bool {
 	return false
 }
 
+func sendBodyTooLarge(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body too large"})
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// maxBodyReader streams a request body to the upstream and fails the read
+// once more than limit bytes have been consumed.
+type maxBodyReader struct {
+	body      io.ReadCloser
+	remaining int64
+	exceeded  int32
+}
+
+func newMaxBodyReader(body io.ReadCloser, limit int64) *maxBodyReader {
+	return &maxBodyReader{body: body, remaining: limit}
+}
+
+func (r *maxBodyReader) Read(p []byte) (int, error) {
+	if r.Exceeded() {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.body.Read(p)
+	if int64(n) > r.remaining {
+		n = int(r.remaining)
+		r.remaining = 0
+		atomic.StoreInt32(&r.exceeded, 1)
+		return n, errBodyTooLarge
+	}
+	r.remaining -= int64(n)
+	return n, err
+}
+
+func (r *maxBodyReader) Close() error {
+	return r.body.Close()
+}
+
+func (r *maxBodyReader) Exceeded() bool {
+	return atomic.LoadInt32(&r.exceeded) == 1
+}
+
 func (route Route) addSecureHeaders(c *gin.Context) {
 	c.Writer.Header().Add("X-Frame-Options", "DENY")
 	c.Writer.Header().Add("X-XSS-Protection", "1; mode=block")
@@ -56,135 +98,243 @@ func (route Route) addCorsHeaders(c *gin.Context) {
 	}
 }
 
-func (conf *Configuration) getLoadBalancer(route Route) (roundrobin.RoundRobin, error) {
-	urls := make([]*url.URL, 0)
-	upstreams := conf.Upstreams[route.ForwardUrl[0:strings.Index(route.ForwardUrl, ":")]]
-	if len(upstreams) == 0 {
-		urls = append(urls, &url.URL{
-			Host: route.ForwardUrl,
-		})
+func (route Route) forwardScheme() string {
+	return route.ForwardUrl[0:strings.Index(route.ForwardUrl, ":")]
+}
+
+// isDiscoveryRoute reports whether the route forwards to a service registered
+// through the discovery endpoint rather than to a URL or a static upstream.
+func (conf *Configuration) isDiscoveryRoute(route Route) bool {
+	if !conf.Discovery {
+		return false
 	}
-	for _, upstream := range upstreams {
-		urls = append(urls, &url.URL{
-			Host: upstream + route.ForwardUrl[strings.Index(route.ForwardUrl, ":")+1:],
-		})
+	switch route.forwardScheme() {
+	case "http", "https", "file":
+		return false
 	}
-	return roundrobin.New(urls...)
+	upstream, ok := conf.Upstreams[route.forwardScheme()]
+	return !ok || upstream == nil || len(upstream.Hosts) == 0
 }
 
-func cidrRangeContains(cidrRange string, checkIP string) bool {
-	_, network, err := net.ParseCIDR(cidrRange)
-	if err != nil {
-		return false
+// getLoadBalancer returns the balancer of the upstream of a route, or one
+// over the forwardUrl itself for routes forwarding to a plain URL. The
+// balancer of a discovered service starts empty and is synced with the
+// registered instances on every request.
+func (conf *Configuration) getLoadBalancer(route Route) (*routeBalancer, error) {
+	path := route.ForwardUrl[strings.Index(route.ForwardUrl, ":")+1:]
+	upstream := conf.Upstreams[route.forwardScheme()]
+	if conf.isDiscoveryRoute(route) {
+		if upstream == nil {
+			return &routeBalancer{loadBalancer: newLoadBalancer(nil, RoundRobin, ""), path: path}, nil
+		}
+		return &routeBalancer{loadBalancer: upstream.getBalancer(route.forwardScheme()), path: path}, nil
+	}
+	if upstream != nil && len(upstream.Hosts) > 0 {
+		return &routeBalancer{loadBalancer: upstream.getBalancer(route.forwardScheme()), path: path}, nil
 	}
-	ip := net.ParseIP(checkIP)
-	return network.Contains(ip)
+	host := &upstreamHost{url: route.ForwardUrl, weight: 1}
+	return &routeBalancer{loadBalancer: newLoadBalancer([]*upstreamHost{host}, RoundRobin, "")}, nil
 }
 
+// Validate checks the configuration and reports every problem found, each
+// tagged with the path of the offending field and, when the configuration was
+// read from a file, the file:line:column of the field.
 func (conf *Configuration) Validate() error {
+	var errs Errors
 	if conf.Listen == "" {
-		return errors.New("listen address is not set")
+		errs = append(errs, conf.fieldError("listen", "listen address is not set"))
+	} else if host, port, err := net.SplitHostPort(conf.Listen); err != nil {
+		errs = append(errs, conf.fieldError("listen", err.Error()))
+	} else {
+		if host != "" && net.ParseIP(host) == nil {
+			if _, err := net.LookupHost(host); err != nil {
+				errs = append(errs, conf.fieldError("listen", err.Error()))
+			}
+		}
+		if port == "0" || port == "" {
+			errs = append(errs, conf.fieldError("listen", "port invalid"))
+		}
+		if port == "80" && (conf.Certificate != "" || conf.Key != "") {
+			log.Println("WARNING: You are attempting to run HTTPS server on port 80. Port 443 is recommended.")
+		}
+		if port == "443" && (conf.Certificate == "" || conf.Key == "") {
+			log.Println("WARNING: You are attempting to run HTTP server on port 443. Port 80 is recommended.")
+		}
 	}
-	host, port, err := net.SplitHostPort(conf.Listen)
-	if err != nil {
-		return err
+	if conf.Log == "" {
+		errs = append(errs, conf.fieldError("log", "log file is not set"))
+	}
+	if conf.ShutdownTimeout < 0 {
+		errs = append(errs, conf.fieldError("shutdownTimeout", "shutdownTimeout must not be negative"))
+	}
+	for i, entry := range conf.TrustedProxies {
+		if _, err := parseCIDRs([]string{entry}); err != nil {
+			errs = append(errs, conf.fieldError(fmt.Sprintf("trustedProxies[%d]", i), err.Error()))
+		}
 	}
-	if host != "" && net.ParseIP(host) == nil {
-		if _, err := net.LookupHost(host); err != nil {
-			return err
+	if name := conf.clientIpHeader(); name != clientIpHeaders[0] && name != clientIpHeaders[1] && name != clientIpHeaders[2] {
+		errs = append(errs, conf.fieldError("clientIpHeader", "clientIpHeader must be X-Forwarded-For, X-Real-IP or CF-Connecting-IP"))
+	}
+	for i, entry := range conf.WhiteList {
+		if _, err := parseCIDRs([]string{entry}); err != nil {
+			errs = append(errs, conf.fieldError(fmt.Sprintf("whiteList[%d]", i), err.Error()))
 		}
 	}
-	if port == "0" || port == "" {
-		return errors.New("port invalid")
+	errs = append(errs, validateAccessRules(conf, "access", conf.Access)...)
+	if check := conf.DiscoveryHealthCheck; check != nil {
+		if check.Path != "" {
+			errs = append(errs, check.validate(conf, "discoveryHealthCheck")...)
+		} else {
+			errs = append(errs, check.validateSettings(conf, "discoveryHealthCheck")...)
+		}
 	}
-	if port == "80" && (conf.Certificate != "" || conf.Key != "") {
-		log.Println("WARNING: You are attempting to run HTTPS server on port 80. Port 443 is recommended.")
+	if conf.DiscoveryAuth != nil {
+		errs = append(errs, conf.DiscoveryAuth.validate(conf, "discoveryAuth")...)
 	}
-	if port == "443" && (conf.Certificate == "" || conf.Key == "") {
-		log.Println("WARNING: You are attempting to run HTTP server on port 443. Port 80 is recommended.")
+	if conf.RetryBudget != nil {
+		errs = append(errs, conf.RetryBudget.validate(conf, "retryBudget")...)
 	}
-	if conf.Log == "" {
-		return errors.New("log file is not set")
+	for _, name := range sortedUpstreamNames(conf.Upstreams) {
+		if upstream := conf.Upstreams[name]; upstream != nil {
+			errs = append(errs, upstream.validate(conf, "upstreams."+name)...)
+		}
 	}
 	if len(conf.Routes) == 0 {
-		return errors.New("no routes are set")
+		errs = append(errs, conf.fieldError("routes", "no routes are set"))
 	}
-	for _, route := range conf.Routes {
+	defined := make(map[string]int)
+	for i, route := range conf.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		methods := route.AllowedMethods
+		if strings.HasPrefix(route.ForwardUrl, "file://") {
+			methods = []string{http.MethodGet, http.MethodHead}
+		}
+		for _, method := range methods {
+			key := strings.ToUpper(method) + " " + route.Path
+			if j, ok := defined[key]; ok {
+				definedBy := fmt.Sprintf("routes[%d]", j)
+				if location := conf.Locations.Locate(definedBy); location != "" {
+					definedBy += " (" + location + ")"
+				}
+				errs = append(errs, conf.fieldError(path+".path", "%s is already defined by %s", key, definedBy))
+				continue
+			}
+			defined[key] = i
+		}
+		if route.IdleTimeout < 0 {
+			errs = append(errs, conf.fieldError(path+".idleTimeout", "%s idleTimeout must not be negative", route.Path))
+		}
+		if route.MaxBodySize < 0 {
+			errs = append(errs, conf.fieldError(path+".maxBodySize", "%s maxBodySize must not be negative", route.Path))
+		}
+		switch route.ForwardedHeaders {
+		case "", ForwardedNone, ForwardedXForwarded, ForwardedRFC7239, ForwardedAll:
+		default:
+			errs = append(errs, conf.fieldError(path+".forwardedHeaders", "forwardedHeaders must be none, xForwarded, forwarded or all"))
+		}
+		errs = append(errs, validateAccessRules(conf, path+".access", route.Access)...)
+		if route.Retry != nil {
+			errs = append(errs, route.Retry.validate(conf, path+".retry")...)
+		}
+		if !strings.HasPrefix(route.Path, "/") {
+			errs = append(errs, conf.fieldError(path+".path", "%s path must begin with /", route.Path))
+		}
+		if route.Path == "/metrics" || conf.Discovery && (route.Path == "/discovery" || strings.HasPrefix(route.Path, "/discovery/")) {
+			errs = append(errs, conf.fieldError(path+".path", "%s is a reserved route", route.Path))
+		}
 		if route.ForwardUrl == "" || !strings.Contains(route.ForwardUrl, ":") {
-			return fmt.Errorf("%s invalid forwardUrl", route.Path)
+			errs = append(errs, conf.fieldError(path+".forwardUrl", "%s invalid forwardUrl", route.Path))
+			continue
 		}
 		if len(route.AllowedMethods) == 0 && route.ForwardUrl[0:strings.Index(route.ForwardUrl, ":")] != "file" {
-			return fmt.Errorf("%s must contain atleast one allowedMethod", route.Path)
+			errs = append(errs, conf.fieldError(path+".allowedMethods", "%s must contain atleast one allowedMethod", route.Path))
 		}
 		if route.ForwardUrl[0:strings.Index(route.ForwardUrl, ":")] != "http" && route.ForwardUrl[0:strings.Index(route.ForwardUrl, ":")] != "file" && route.ForwardUrl[0:strings.Index(route.ForwardUrl, ":")] != "https" {
-			if _, ok := conf.Upstreams[route.ForwardUrl[0:strings.Index(route.ForwardUrl, ":")]]; !ok {
-				return fmt.Errorf("%s forwardUrl not in upstream", route.ForwardUrl)
+			if _, ok := conf.Upstreams[route.ForwardUrl[0:strings.Index(route.ForwardUrl, ":")]]; !ok && !conf.Discovery {
+				errs = append(errs, conf.fieldError(path+".forwardUrl", "%s forwardUrl not in upstream", route.ForwardUrl))
 			}
 		}
-		if conf.Discovery && route.Path == "/discovery" {
-			return fmt.Errorf("%s is a reserved route", route.Path)
+		if route.Discovery != nil && !conf.isDiscoveryRoute(route) {
+			errs = append(errs, conf.fieldError(path+".discovery", "%s does not forward to a discovered service", route.Path))
 		}
 	}
-	return nil
+	if len(errs) > 0 {
+		return errs
+	}
+	return conf.validateRouteTree()
 }
 
-func (s *DiscoveryService) GetService(serviceName string) (*DiscoveryClient, error) {
-	if _, ok := s.services[serviceName]; !ok {
-		return nil, errors.New("service not found")
+// validateRouteTree registers the routes on an empty engine, after the routes
+// goginx adds itself, to report the paths gin refuses, such as a wildcard
+// conflicting with another path, before they panic while the server is built.
+func (conf *Configuration) validateRouteTree() error {
+	var errs Errors
+	r := gin.New()
+	noop := func(*gin.Context) {}
+	r.GET("/metrics", noop)
+	if conf.Discovery {
+		r.POST("/discovery", noop)
+		r.DELETE("/discovery", noop)
+		r.GET("/discovery", noop)
+		r.GET("/discovery/:service", noop)
 	}
-	s.serviceCurrentIndex[serviceName] = (s.serviceCurrentIndex[serviceName] + 1) % len(s.services[serviceName])
-	service := s.services[serviceName][s.serviceCurrentIndex[serviceName]]
-	if !service.Active {
-		atLeastOneActive := false
-		for _, service := range s.services[serviceName] {
-			if service.Active {
-				atLeastOneActive = true
-				break
+	for i, route := range conf.Routes {
+		route := route
+		err := recoverRouteError(func() {
+			if strings.HasPrefix(route.ForwardUrl, "file://") {
+				r.StaticFS(route.Path, http.Dir("."))
+				return
 			}
+			for _, method := range route.AllowedMethods {
+				r.Handle(method, route.Path, noop)
+			}
+		})
+		if err != nil {
+			errs = append(errs, conf.fieldError(fmt.Sprintf("routes[%d].path", i), "%s cannot be routed: %s", route.Path, err))
 		}
-		if !atLeastOneActive {
-			return nil, errors.New("no active service found")
-		}
-		return s.GetService(serviceName)
 	}
-	return &service, nil
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
-func (s *DiscoveryService) AppendService(service *DiscoveryClient) {
-	if _, ok := s.services[service.Service]; !ok {
-		s.services[service.Service] = make([]DiscoveryClient, 0)
-	}
-	for _, client := range s.services[service.Service] {
-		if client.Host == service.Host && client.Port == service.Port {
-			client.Active = true
-			return
+// recoverRouteError runs register and returns the panic gin raises for a route
+// it cannot add as an error.
+func recoverRouteError(register func()) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("%v", recovered)
 		}
-	}
-	s.services[service.Service] = append(s.services[service.Service], *service)
+	}()
+	register()
+	return nil
 }
 
-func (s *DiscoveryService) HeartBeatServices() {
-	for {
-		for serviceName, serviceClients := range s.services {
-			for _, serviceClient := range serviceClients {
-				conn, err := net.DialTimeout("tcp", net.JoinHostPort(serviceClient.Service, strconv.Itoa(serviceClient.Port)), time.Second)
-				conn.Close()
-				serviceClient.Active = err == nil
-			}
-			s.services[serviceName] = serviceClients
+// setting is a named numeric field of a configuration block.
+type setting struct {
+	name  string
+	value int
+}
+
+// nonNegative reports every one of settings, the fields of the block at path,
+// that is negative.
+func (conf *Configuration) nonNegative(path string, settings ...setting) Errors {
+	var errs Errors
+	for _, s := range settings {
+		if s.value < 0 {
+			errs = append(errs, conf.fieldError(path+"."+s.name, "%s must not be negative", s.name))
 		}
-		<-time.After(time.Second * 60)
 	}
+	return errs
 }
 
-func (s *DiscoveryService) MarkInactive(client *DiscoveryClient) {
-	if _, ok := s.services[client.Service]; !ok {
-		return
-	}
-	for _, serviceClient := range s.services[client.Service] {
-		if serviceClient.Host == client.Host && serviceClient.Port == client.Port {
-			serviceClient.Active = false
-			return
-		}
+// fieldError builds a FieldError for path, locating it at the closest field
+// (the path itself or one of its parents) that was read from a file.
+func (conf *Configuration) fieldError(path string, format string, args ...interface{}) *FieldError {
+	return &FieldError{
+		Location: conf.Locations.Locate(path),
+		Path:     path,
+		Message:  fmt.Sprintf(format, args...),
 	}
 }
@@ -1,6 +1,8 @@
 package handler
 
 import (
+	"io/ioutil"
+	"strings"
 	"testing"
 )
 
@@ -166,6 +168,38 @@ func TestValidatePort(t *testing.T) {
 	}
 }
 
+func TestValidateRouteTree(t *testing.T) {
+	tests := map[string][]Route{
+		"wildcard conflict": {
+			{Path: "/a/:id", AllowedMethods: []string{"GET"}, ForwardUrl: "http://localhost/"},
+			{Path: "/a/*x", AllowedMethods: []string{"GET"}, ForwardUrl: "http://localhost/"},
+		},
+		"reserved metrics": {
+			{Path: "/metrics", AllowedMethods: []string{"GET"}, ForwardUrl: "http://localhost/"},
+		},
+		"no leading slash": {
+			{Path: "a", AllowedMethods: []string{"GET"}, ForwardUrl: "http://localhost/"},
+		},
+		"invalid method": {
+			{Path: "/", AllowedMethods: []string{"get"}, ForwardUrl: "http://localhost/"},
+		},
+		"static parameter": {
+			{Path: "/:dir", ForwardUrl: "file://."},
+		},
+	}
+	for name, routes := range tests {
+		conf := &Configuration{Listen: ":80", Log: "./log", Routes: routes}
+		err := conf.Validate()
+		if err == nil {
+			t.Errorf("%s: routes gin refuses must not validate", name)
+			continue
+		}
+		if !strings.Contains(err.Error(), "routes[") {
+			t.Errorf("%s: the error must point to the route, got %s", name, err)
+		}
+	}
+}
+
 func TestGetLoadBalancer(t *testing.T) {
 	urls := []string{
 		"http://localhost:8080",
@@ -174,9 +208,13 @@ func TestGetLoadBalancer(t *testing.T) {
 		"http://localhost:8083",
 		"http://localhost:8084",
 	}
+	hosts := make([]UpstreamHost, len(urls))
+	for i, url := range urls {
+		hosts[i] = UpstreamHost{Url: url}
+	}
 	conf := Configuration{
-		Upstreams: map[string][]string{
-			"test": urls,
+		Upstreams: map[string]*Upstream{
+			"test": {Hosts: hosts},
 		},
 		Routes: []Route{
 			{
@@ -233,14 +271,23 @@ func TestGetLoadBalancerNoUpstream(t *testing.T) {
 	}
 }
 
-func TestCidrRangeContains(t *testing.T) {
-	if !cidrRangeContains("192.168.1.0/24", "192.168.1.180") {
-		t.Error("cidrRangeContains failed")
+func TestMaxBodyReader(t *testing.T) {
+	body := newMaxBodyReader(ioutil.NopCloser(strings.NewReader("0123456789")), 10)
+	if _, err := ioutil.ReadAll(body); err != nil {
+		t.Error(err)
+	}
+	if body.Exceeded() {
+		t.Error("body of exactly the limit must not exceed")
 	}
 }
 
-func TestCidrRangeNotContains(t *testing.T) {
-	if cidrRangeContains("192.168.1.0/24", "192.168.2.180") {
-		t.Error("cidrRangeContains failed")
+func TestMaxBodyReaderExceeded(t *testing.T) {
+	body := newMaxBodyReader(ioutil.NopCloser(strings.NewReader("0123456789")), 5)
+	data, err := ioutil.ReadAll(body)
+	if err != errBodyTooLarge {
+		t.Errorf("expected errBodyTooLarge, got %v", err)
+	}
+	if len(data) != 5 || !body.Exceeded() {
+		t.Error("maxBodyReader must stop at the limit")
 	}
 }
@@ -7,5 +7,7 @@ import (
 )
 
 func main() {
-	log.Fatal(app.Start())
+	if err := app.Start(); err != nil {
+		log.Fatal(err)
+	}
 }